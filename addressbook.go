@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Имя общей адресной книги со всеми клиентами
+	AddressBookCombined = "contacts"
+	// Префикс имени адресной книги класса клиентов
+	AddressBookClassPrefix = "class-"
+)
+
+// Адресная книга пользователя: все клиенты SBSS или
+// клиенты одного класса
+type AddressBook struct {
+	// Класс клиентов SBSS, 0 - все клиенты
+	Classid int
+	// Название класса
+	Classname string
+}
+
+// Получи адресную книгу по имени в пути, вернет nil,
+// если имя не соответствует ни одной книге
+func ParseAddressBook(name string) *AddressBook {
+	var (
+		id  int
+		err error
+	)
+
+	if name == AddressBookCombined {
+		return &AddressBook{}
+	}
+
+	if !strings.HasPrefix(name, AddressBookClassPrefix) {
+		return nil
+	}
+
+	if id, err = strconv.Atoi(strings.TrimPrefix(name, AddressBookClassPrefix)); err != nil || id <= 0 {
+		return nil
+	}
+
+	return &AddressBook{Classid: id}
+}
+
+// Собери список адресных книг по классам клиентов,
+// первой всегда идет общая книга
+func AddressBooks(users []*User) (books []*AddressBook) {
+	var (
+		classes = make(map[int]string)
+	)
+
+	for _, item := range users {
+		if item.Classid > 0 {
+			classes[item.Classid] = item.Classname
+		}
+	}
+
+	for id, name := range classes {
+		books = append(books, &AddressBook{
+			Classid:   id,
+			Classname: name,
+		})
+	}
+
+	sort.Slice(books, func(i, j int) bool {
+		return books[i].Classid < books[j].Classid
+	})
+
+	return append([]*AddressBook{&AddressBook{}}, books...)
+}
+
+// Имя книги в пути
+func (this *AddressBook) Name() string {
+	if this.Classid == 0 {
+		return AddressBookCombined
+	}
+
+	return AddressBookClassPrefix + strconv.Itoa(this.Classid)
+}
+
+// Запрос клиентов книги к SBSS
+func (this *AddressBook) Request(filter *ClientsRequest) *ClientsRequest {
+	if filter == nil {
+		filter = &ClientsRequest{}
+	}
+
+	filter.Classid = this.Classid
+
+	return filter
+}
+
+// Проверь, что клиент относится к книге
+func (this *AddressBook) Contains(item *User) bool {
+	return this.Classid == 0 || this.Classid == item.Classid
+}
+
+// Получи клиентов книги
+func (this *AddressBook) Clients(ctx *ContextAdapter, filter *ClientsRequest) (clients *ClientsList, err error) {
+	var (
+		users []*User
+	)
+
+	if clients, err = ctx.GetClients(ctx.User, ctx.Password, this.Request(filter)); err != nil {
+		return
+	}
+
+	if !clients.Success && clients.Error != "" {
+		return nil, &SbssResponseError{
+			Challenge: clients.Challenge,
+			Message:   clients.Error,
+		}
+	}
+
+	if this.Classid == 0 {
+		return
+	}
+
+	// SBSS может вернуть лишних клиентов, если класс не указан
+	for _, item := range clients.Users {
+		if this.Contains(item) {
+			users = append(users, item)
+
+			if this.Classname == "" {
+				this.Classname = item.Classname
+			}
+		}
+	}
+
+	clients.Users = users
+
+	return
+}
+
+// Сохрани снимок книги и верни его sync-token
+func (this *AddressBook) SyncToken(ctx *ContextAdapter) (token string, err error) {
+	var (
+		clients *ClientsList
+	)
+
+	if clients, err = this.Clients(ctx, nil); err != nil {
+		return
+	}
+
+	return ctx.Tokens.Put(ctx.User, ctx.URL.Book(this), contactETags(ctx, this, clients.Users)), nil
+}
+
+// Название книги для клиента адресной книги
+func (this *AddressBook) DisplayName(ctx *ContextAdapter) string {
+	if this.Classid == 0 {
+		return "SBSS contacts"
+	}
+
+	return "SBSS " + this.className(ctx)
+}
+
+// Описание книги, RFC 6352 6.2.1
+func (this *AddressBook) Description(ctx *ContextAdapter) string {
+	if this.Classid == 0 {
+		return "All SBSS clients"
+	}
+
+	return "SBSS clients of class " + this.className(ctx)
+}
+
+// Название класса книги, если оно неизвестно, то
+// запроси клиентов класса у SBSS
+func (this *AddressBook) className(ctx *ContextAdapter) string {
+	if this.Classname == "" {
+		if _, err := this.Clients(ctx, nil); err != nil {
+			ctx.Error(err)
+		}
+	}
+
+	if this.Classname == "" {
+		return this.Name()
+	}
+
+	return this.Classname
+}
+
+// Верни книгу запроса, по умолчанию общую
+func contextBook(ctx *ContextAdapter) *AddressBook {
+	if ctx.Book == nil {
+		ctx.Book = &AddressBook{}
+	}
+
+	return ctx.Book
+}
+
+// Определи адресную книгу по параметру маршрута book
+func HandleAddressBook(fn ContextHandlerFunc) ContextHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+		if ctx.Book = ParseAddressBook(ctx.Params.ByName("book")); ctx.Book == nil {
+			ctx.Warn("Unknown address book: %s", ctx.Params.ByName("book"))
+
+			http.NotFound(w, r)
+			return
+		}
+
+		ctx.Href = ctx.URL.Book(ctx.Book)
+		ctx.Resource = ResourceCollection
+
+		fn(w, r, ctx)
+	}
+}
+
+// Собери ETag контактов книги по их href
+func contactETags(ctx *ContextAdapter, book *AddressBook, users []*User) map[string]string {
+	var items = make(map[string]string, len(users))
+
+	for _, item := range bookContacts(users) {
+		items[ctx.URL.Contact(book, item)] = item.ETag()
+	}
+
+	return items
+}
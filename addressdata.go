@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MimeVCard = "text/vcard"
+	MimeJCard = "application/vcard+json"
+)
+
+// Формат данных контакта, RFC 6352 10.4
+type AddressDataType struct {
+	ContentType string
+	Version     string
+}
+
+// Поддерживаемые форматы, первый используется по умолчанию
+var AddressDataTypes = []*AddressDataType{
+	&AddressDataType{MimeVCard, "3.0"},
+	&AddressDataType{MimeVCard, "4.0"},
+	&AddressDataType{MimeJCard, "4.0"},
+}
+
+// Представление клиента SBSS в vCard 4.0, RFC 6350
+type userCard4 struct {
+	Kind         string   `vcard:"kind,omitempty"`
+	Name         string   `vcard:"fn,escape"`
+	FullName     []string `vcard:"n,inline,omitempty,escape"`
+	Organization string   `vcard:"org,omitempty,escape"`
+	Email        string   `vcard:"email,omitempty,escape"`
+	Uid          string   `vcard:"uid"`
+	Classname    string   `vcard:"categories,omitempty,escape"`
+	Members      []string `vcard:"member,iteminline,omitempty"`
+}
+
+type vcardWrap4 struct {
+	Item interface{} `vcard:",omitname,wrapvcard,version(4.0)"`
+}
+
+// Найди поддерживаемый формат по атрибутам card:address-data,
+// вернет nil, если формат не поддерживается
+func ParseAddressDataType(contentType, version string) *AddressDataType {
+	if contentType == "" {
+		contentType = MimeVCard
+	}
+
+	for _, item := range AddressDataTypes {
+		if item.ContentType != contentType {
+			continue
+		}
+
+		if version == "" || version == item.Version {
+			return item
+		}
+	}
+
+	return nil
+}
+
+// Выбери формат по заголовку Accept с учетом q. Без заголовка
+// используется формат по умолчанию, nil - ни один формат не подходит
+func NegotiateAddressData(accept string) *AddressDataType {
+	type mediaRange struct {
+		mediatype string
+		version   string
+		q         float64
+	}
+
+	var (
+		ranges []mediaRange
+	)
+
+	if strings.TrimSpace(accept) == "" {
+		return AddressDataTypes[0]
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediatype, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		item := mediaRange{mediatype: mediatype, version: params["version"], q: 1}
+
+		if v, ok := params["q"]; ok {
+			if item.q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		if item.q > 0 {
+			ranges = append(ranges, item)
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	for _, item := range ranges {
+		switch item.mediatype {
+		case "*/*", "text/*":
+			return AddressDataTypes[0]
+
+		case "text/x-vcard":
+			item.mediatype = MimeVCard
+		}
+
+		if v := ParseAddressDataType(item.mediatype, item.version); v != nil {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// Значение заголовка Content-Type для формата
+func (this *AddressDataType) MimeType() string {
+	if this.ContentType == MimeJCard {
+		return this.ContentType
+	}
+
+	if this.Version == "3.0" {
+		return this.ContentType + "; charset=utf-8"
+	}
+
+	return this.ContentType + "; charset=utf-8; version=" + this.Version
+}
+
+// Элемент card:address-data-type для supported-address-data
+func (this *AddressDataType) XmlElem() string {
+	return `<card:address-data-type content-type="` + this.ContentType + `" version="` + this.Version + `"/>`
+}
+
+// Закодируй контакт в формате, props ограничивает набор
+// свойств vCard, nil - все свойства
+func (this *AddressDataType) Encode(item *User, props map[string]bool) []byte {
+	if this.Version == "3.0" {
+		if item.IsGroup() {
+			return EncodeWrapProps(item.Group3(), props)
+		}
+
+		return EncodeWrapProps(item, props)
+	}
+
+	card := encodeProps(vcardWrap4{}, item.Card4(), props)
+
+	if this.ContentType == MimeJCard {
+		return vcardToJCard(card)
+	}
+
+	return card
+}
+
+// ETag представления контакта: хэш формата и карточки, поэтому
+// он меняется и при изменении самого представления клиента SBSS
+func (this *AddressDataType) ETag(item *User) string {
+	var h = sha1.New()
+
+	h.Write([]byte(this.ContentType + ";version=" + this.Version + "\n"))
+	h.Write(this.Encode(item, nil))
+
+	return `"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+}
+
+// ETag контакта совпадает с ETag одного из его представлений
+func matchContactETag(header string, item *User) bool {
+	for _, format := range AddressDataTypes {
+		if matchETag(header, format.ETag(item)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Формат, запрошенный в card:address-data, по умолчанию vCard 3.0
+func contextAddressData(ctx *ContextAdapter) *AddressDataType {
+	if ctx.AddressData == nil {
+		return AddressDataTypes[0]
+	}
+
+	return ctx.AddressData
+}
+
+// Определи формат и свойства card:address-data в запросе REPORT,
+// вернет ошибку card:supported-address-data для неизвестного формата
+func requestAddressData(req *XML_Request, ctx *ContextAdapter) error {
+	var (
+		item *Known_XML_Property
+		ok   bool
+	)
+
+	if item, ok = req.Get("address-data").(*Known_XML_Property); !ok {
+		return nil
+	}
+
+	if ctx.AddressData = ParseAddressDataType(item.XmlRequest.ContentType, item.XmlRequest.Version); ctx.AddressData == nil {
+		return NewDAVError(http.StatusForbidden, "card:supported-address-data")
+	}
+
+	ctx.AddressProps = item.XmlRequest.Properties()
+
+	return nil
+}
+
+// Свойства vCard из card:prop: имя свойства и признак передачи
+// значения. Для card:allprop или без card:prop вернет nil
+func (this *Property_XML_Request) Properties() (props map[string]bool) {
+	if this.AllProp != nil || len(this.Props) == 0 {
+		return nil
+	}
+
+	props = make(map[string]bool, len(this.Props))
+
+	for _, item := range this.Props {
+		props[strings.ToUpper(item.Name)] = item.NoValue != "yes"
+	}
+
+	return
+}
+
+// Представление клиента в vCard 4.0
+func (this *User) Card4() *userCard4 {
+	var card = &userCard4{
+		Name:      this.Name,
+		FullName:  this.FullName,
+		Uid:       this.Uid,
+		Classname: this.Classname,
+	}
+
+	if this.IsGroup() {
+		card.Kind = "group"
+		card.FullName = []string{this.Name}
+		card.Classname = ""
+		card.Members = this.MemberUris()
+	}
+
+	if this.Type == 1 {
+		card.Kind = "org"
+		card.Organization = this.Organization
+	}
+
+	if this.Email != nil {
+		card.Email = this.Email.Value
+	}
+
+	return card
+}
+
+// Типы значений свойств, которые по умолчанию не текст, RFC 6350
+var jcardValueTypes = map[string]string{
+	"member": "uri",
+	"uid":    "uri",
+	"url":    "uri",
+}
+
+// Преобразуй vCard в jCard, RFC 7095. Значения структурных
+// свойств N, ADR и ORG передаются массивом компонент
+func vcardToJCard(card []byte) []byte {
+	var (
+		props = []interface{}{}
+	)
+
+	for _, line := range strings.Split(vcardUnfold(string(card)), "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		idx := strings.Index(line, ":")
+		if idx < 0 {
+			continue
+		}
+
+		parts := strings.Split(line[:idx], ";")
+		name := strings.ToLower(parts[0])
+
+		if name == "begin" || name == "end" {
+			continue
+		}
+
+		params := make(map[string]string)
+		vtype := "text"
+
+		if v, ok := jcardValueTypes[name]; ok {
+			vtype = v
+		}
+
+		for _, p := range parts[1:] {
+			if kv := strings.SplitN(p, "=", 2); len(kv) == 2 {
+				if strings.EqualFold(kv[0], "value") {
+					vtype = strings.ToLower(kv[1])
+					continue
+				}
+
+				params[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+
+		prop := []interface{}{name, params, vtype}
+
+		switch name {
+		case "n", "adr", "org":
+			var values []string
+
+			for _, v := range vcardSplit(line[idx+1:], ';') {
+				values = append(values, vcardUnescape(v))
+			}
+
+			prop = append(prop, values)
+
+		case "categories":
+			for _, v := range vcardSplit(line[idx+1:], ',') {
+				prop = append(prop, vcardUnescape(v))
+			}
+
+		default:
+			prop = append(prop, vcardUnescape(line[idx+1:]))
+		}
+
+		props = append(props, prop)
+	}
+
+	data, _ := json.Marshal([]interface{}{"vcard", props})
+
+	return data
+}
+
+// Раздели значение свойства vCard по неэкранированному разделителю
+func vcardSplit(value string, sep rune) (list []string) {
+	var (
+		escaped bool
+		start   int
+	)
+
+	for i, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+
+		case r == '\\':
+			escaped = true
+
+		case r == sep:
+			list = append(list, value[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(list, value[start:])
+}
@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"encoding/xml"
+	"net"
+	"net/http"
+	"net/url"
 	"strconv"
 )
 
 type XML_Request struct {
 	XMLName    xml.Name
-	Properties XML_Properties `xml:"prop"`
+	SyncToken  string              `xml:"sync-token"`
+	Properties XML_Properties      `xml:"prop"`
+	Filter     *Filter_XML_Request `xml:"filter"`
+	Limit      int                 `xml:"limit>nresults"`
+	Hrefs      []string            `xml:"href"`
+	// Запрос всех свойств или только их имен, RFC 4918 9.1
+	AllProp  *struct{}      `xml:"allprop"`
+	PropName *struct{}      `xml:"propname"`
+	Include  XML_Properties `xml:"include"`
 }
 
 type XML_Properties []XMLPropertyIface
@@ -16,6 +28,10 @@ type XMLPropertyIface interface {
 	Name() string
 	Prefix() string
 	Status() int
+	// Свойство есть у ресурса указанного типа
+	Applies(int) bool
+	// Свойство входит в ответ на allprop
+	AllProp() bool
 	XmlElem(*ContextAdapter) XML_Element
 }
 
@@ -23,7 +39,10 @@ type XML_Property struct {
 	XmlInner    []byte
 	XmlName     string
 	XmlNsPrefix string
-	XmlStatus   int
+	// Пространство имен неизвестного свойства, используется
+	// вместо префикса, чтобы вернуть клиенту то же имя
+	XmlNamespace string
+	XmlStatus    int
 }
 
 type Multistatus_XML_Response struct {
@@ -31,15 +50,53 @@ type Multistatus_XML_Response struct {
 	XmlnsDAV  string   `xml:"xmlns:d,attr"`
 	XmlnsCard string   `xml:"xmlns:card,attr"`
 	XmlnsCS   string   `xml:"xmlns:cs,attr"`
-	Token     string   `xml:"sync-token,omitempty"`
 	Responses []*XML_Response
+	Token     string `xml:"d:sync-token,omitempty"`
+	// Поток записи ответа, nil - ответ кодируется целиком
+	stream *multistatusStream
 }
 
 type XML_Response struct {
-	XMLName    xml.Name            `xml:"d:response"`
-	Href       string              `xml:"d:href,omitempty"`
-	Properties []*XML_Elements     `xml:"d:propstat>d:prop"`
-	Status     Status_XML_Response `xml:"d:propstat>d:status"`
+	XMLName   xml.Name                 `xml:"d:response"`
+	Href      string                   `xml:"d:href,omitempty"`
+	Propstats []*Propstat_XML_Response `xml:"d:propstat"`
+	// Статус ресурса целиком, когда свойства не передаются
+	ResourceStatus *Status_XML_Response `xml:"d:status"`
+	// Нарушенное условие, например, усечение ответа, RFC 4918 16
+	Error *XML_Element `xml:"d:error"`
+}
+
+// Группа свойств ресурса с общим статусом
+type Propstat_XML_Response struct {
+	Properties  *XML_Elements       `xml:"d:prop"`
+	Status      Status_XML_Response `xml:"d:status"`
+	Error       *XML_Element        `xml:"d:error"`
+	Description string              `xml:"d:responsedescription,omitempty"`
+	// Имя нарушенного условия, по нему свойства с одним
+	// статусом разделяются на группы
+	condition string
+}
+
+// Ответ с описанием нарушенного условия обработки
+// запроса, RFC 4918 16
+type Error_XML_Response struct {
+	XMLName   xml.Name `xml:"d:error"`
+	XmlnsDAV  string   `xml:"xmlns:d,attr"`
+	XmlnsCard string   `xml:"xmlns:card,attr"`
+	Condition XML_Element
+}
+
+// Ошибка обработки запроса с кодом ответа и условием,
+// которое передается клиенту в теле DAV:error.
+// Условие указывается с префиксом пространства имен,
+// например, d:valid-sync-token или card:supported-filter.
+// Без условия клиент получит только код ответа
+type DAV_Error struct {
+	Code      int
+	Condition string
+	// Содержимое элемента условия, например, ресурс и
+	// привилегия для d:need-privileges
+	Content []byte
 }
 
 type XML_Elements struct {
@@ -50,12 +107,15 @@ type Status_XML_Response struct {
 	value int
 }
 
-type CTag_XML_Property XML_Property
-
+// Элемент свойства в ответе. Status, Error и Condition
+// определяют группу propstat, в которую попадет свойство
 type XML_Element struct {
-	XMLName         xml.Name
-	Data            []byte `xml:",innerxml"`
-	Error           string `xml:"d:error,omitempty"`
+	XMLName xml.Name
+	Data    []byte `xml:",innerxml"`
+	// Текстовое значение, экранируется при записи ответа
+	Text            []byte `xml:",chardata"`
+	Error           string `xml:"-"`
+	Condition       string `xml:"-"`
 	Status          int    `xml:"-"`
 	UnmarshaledName string `xml:"-"`
 }
@@ -64,90 +124,63 @@ type XmlResponseIface interface {
 	Do(*ContextAdapter) (int, []byte)
 }
 
-var Known_Properties map[string]func(xml.StartElement) XMLPropertyIface
+// Типы ресурсов, по умолчанию ресурс считается адресной книгой
+const (
+	ResourceCollection = iota
+	ResourceHome
+	ResourcePrincipal
+	ResourceContact
+)
 
-func init() {
-	Known_Properties = map[string]func(xml.StartElement) XMLPropertyIface{
-		// Support CTag property
-		"getctag": func(start xml.StartElement) XMLPropertyIface {
-			return &CTag_XML_Property{
-				XmlName:     start.Name.Local,
-				XmlNsPrefix: "cs",
-				XmlStatus:   200,
-			}
-		},
+func NewMultiStatus() Multistatus_XML_Response {
+	return Multistatus_XML_Response{
+		XmlnsDAV:  NamespaceDAV,
+		XmlnsCard: NamespaceCardDAV,
+		XmlnsCS:   NamespaceCS,
+	}
+}
 
-		"addressbook-home-set": func(start xml.StartElement) XMLPropertyIface {
-			return &XML_Property{
-				XmlName:     start.Name.Local,
-				XmlNsPrefix: "card",
-				XmlStatus:   200,
-				XmlInner:    []byte("<d:href>/carddav/contacts</d:href>"),
-			}
-		},
+func NewDAVError(code int, condition string) *DAV_Error {
+	return &DAV_Error{
+		Code:      code,
+		Condition: condition,
+	}
+}
 
-		"supported-report-set": func(start xml.StartElement) XMLPropertyIface {
-			return &XML_Property{
-				XmlName:     start.Name.Local,
-				XmlNsPrefix: "d",
-				XmlStatus:   200,
-				XmlInner:    []byte("<d:supported-report><d:report><d:sync-collection/></d:report></d:supported-report>"),
-			}
-		},
+// Элемент DAV:error с указанным условием
+func NewXmlConditionElement(condition string) *XML_Element {
+	var el = NewXmlElement("d:error", []byte("<"+condition+"/>"))
 
-		"displayname": func(start xml.StartElement) XMLPropertyIface {
-			return &XML_Property{
-				XmlName:     start.Name.Local,
-				XmlNsPrefix: "d",
-				XmlStatus:   200,
-				XmlInner:    []byte("SBSS contacts"),
-			}
-		},
+	return &el
+}
 
-		"resourcetype": func(start xml.StartElement) XMLPropertyIface {
-			return &XML_Property{
-				XmlName:     start.Name.Local,
-				XmlNsPrefix: "d",
-				XmlStatus:   200,
-				XmlInner:    []byte("<d:collection/><card:addressbook/>"),
-			}
-		},
+// Ошибка обращения к SBSS серверу: недоступность сервера
+// вернет 503, неверные учетные данные 401, отказ SBSS 403,
+// остальные ошибки 502
+func NewSbssError(err error) *DAV_Error {
+	switch e := err.(type) {
+	case *DAV_Error:
+		return e
+
+	case *SbssResponseError:
+		if e.Challenge != 0 {
+			return NewDAVError(http.StatusUnauthorized, "")
+		}
 
-		"getcontenttype": func(start xml.StartElement) XMLPropertyIface {
-			return &XML_Property{
-				XmlName:     start.Name.Local,
-				XmlNsPrefix: "d",
-				XmlStatus:   200,
-				XmlInner:    []byte("text/x-vcard; charset=utf-8"),
-			}
-		},
+		return NewDAVError(http.StatusForbidden, "")
 
-		"current-user-principal": func(start xml.StartElement) XMLPropertyIface {
-			return &XML_Property{
-				XmlName:     start.Name.Local,
-				XmlNsPrefix: "d",
-				XmlStatus:   200,
-				XmlInner:    []byte("<d:href>/carddav</d:href>"),
-			}
-		},
+	case *url.Error:
+		if _, ok := e.Err.(*net.OpError); ok || e.Timeout() {
+			return NewDAVError(http.StatusServiceUnavailable, "")
+		}
 
-		"getetag": func(start xml.StartElement) XMLPropertyIface {
-			return &XML_Property{
-				XmlName:     start.Name.Local,
-				XmlNsPrefix: "d",
-				XmlStatus:   200,
-				XmlInner:    []byte(nil),
-			}
-		},
+	case net.Error:
+		if e.Timeout() {
+			return NewDAVError(http.StatusServiceUnavailable, "")
+		}
 	}
-}
 
-func NewMultiStatus() Multistatus_XML_Response {
-	return Multistatus_XML_Response{
-		XmlnsDAV:  "DAV:",
-		XmlnsCard: "urn:ietf:params:xml:ns:carddav",
-		XmlnsCS:   "http://calendarserver.org/ns/",
-	}
+	return NewDAVError(http.StatusBadGateway, "")
 }
 
 func NewXmlElement(name string, data []byte) XML_Element {
@@ -160,7 +193,6 @@ func NewXmlElement(name string, data []byte) XML_Element {
 func (this *XML_Properties) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	var (
 		elem XMLPropertyIface
-		name string
 	)
 
 	for {
@@ -171,19 +203,30 @@ func (this *XML_Properties) UnmarshalXML(d *xml.Decoder, start xml.StartElement)
 		}
 
 		switch startElement := token.(type) {
+		case xml.EndElement:
+			return nil
+
 		case xml.StartElement:
-			name = startElement.Name.Local
-
-			if item, ok := Known_Properties[name]; ok {
-				elem = item(startElement)
-			} else {
-				elem = XMLPropertyIface(&XML_Property{
-					XmlName:   name,
-					XmlStatus: 404,
-				})
+			if elem = LookupProperty(startElement.Name); elem != nil {
+				(*this) = append((*this), elem)
+
+				// Параметры свойства, например, card:prop в card:address-data
+				if err := d.DecodeElement(&elem.(*Known_XML_Property).XmlRequest, &startElement); err != nil {
+					return err
+				}
+
+				continue
 			}
 
-			(*this) = append((*this), elem)
+			(*this) = append((*this), XMLPropertyIface(&XML_Property{
+				XmlName:      startElement.Name.Local,
+				XmlNamespace: startElement.Name.Space,
+				XmlStatus:    404,
+			}))
+
+			if err := d.Skip(); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -192,24 +235,51 @@ func (this *XML_Properties) UnmarshalXML(d *xml.Decoder, start xml.StartElement)
 
 // Encode Status struct to the XML Element
 func (this Status_XML_Response) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
-	s := "HTTP/1.1 " + strconv.Itoa(this.value) + " "
+	s := "HTTP/1.1 " + strconv.Itoa(this.value) + " " + http.StatusText(this.value)
 
-	switch this.value {
-	case 200:
-		s += "Ok"
+	return e.EncodeElement(s, start)
+}
+
+func (this *DAV_Error) Error() string {
+	return strconv.Itoa(this.Code) + " " + this.Condition
+}
 
-	case 404:
-		s += "Not Found"
+// Отправь клиенту код ответа и тело DAV:error
+func (this *DAV_Error) Write(w http.ResponseWriter) (int, error) {
+	var (
+		body []byte
+		err  error
+	)
+
+	if this.Condition == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		WriteStatus(w, this.Code)
+
+		return w.Write([]byte(http.StatusText(this.Code) + "\n"))
 	}
 
-	e.EncodeElement(s, start)
-	return nil
+	if body, err = xml.Marshal(Error_XML_Response{
+		XmlnsDAV:  NamespaceDAV,
+		XmlnsCard: NamespaceCardDAV,
+		Condition: NewXmlElement(this.Condition, this.Content),
+	}); err != nil {
+		return 0, err
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	WriteStatus(w, this.Code)
+
+	return w.Write(body)
 }
 
 func (this *Multistatus_XML_Response) AddResponse(status int, items *XML_Elements) (resp *XML_Response) {
 	resp = &XML_Response{
-		Properties: []*XML_Elements{items},
-		Status:     Status_XML_Response{status},
+		Propstats: []*Propstat_XML_Response{
+			&Propstat_XML_Response{
+				Properties: items,
+				Status:     Status_XML_Response{status},
+			},
+		},
 	}
 
 	this.Responses = append(this.Responses, resp)
@@ -217,8 +287,35 @@ func (this *Multistatus_XML_Response) AddResponse(status int, items *XML_Element
 	return
 }
 
+// Добавь ответ со статусом ресурса без свойств, например,
+// для удаленного контакта в sync-collection
+func (this *Multistatus_XML_Response) AddStatusResponse(href string, status int) (resp *XML_Response) {
+	resp = &XML_Response{
+		Href:           href,
+		ResourceStatus: &Status_XML_Response{status},
+	}
+
+	this.Responses = append(this.Responses, resp)
+
+	return
+}
+
+// Добавь ответ об усечении результата запроса ограничением
+// числа совпадений, RFC 6352 8.6.1 и RFC 6578 3.6
+func (this *Multistatus_XML_Response) AddLimitResponse(href string) (resp *XML_Response) {
+	resp = this.AddStatusResponse(href, http.StatusInsufficientStorage)
+	resp.Error = NewXmlConditionElement("d:number-of-matches-within-limits")
+
+	return
+}
+
 func (this *XML_Request) Get(name string) XMLPropertyIface {
-	for _, item := range this.Properties {
+	return this.Properties.Get(name)
+}
+
+// Найди свойство по имени
+func (this XML_Properties) Get(name string) XMLPropertyIface {
+	for _, item := range this {
 		if item.Name() == name {
 			return item
 		}
@@ -226,32 +323,127 @@ func (this *XML_Request) Get(name string) XMLPropertyIface {
 	return nil
 }
 
+// Свойства, которые нужно вернуть для ресурса указанного типа:
+// для allprop и propname это свойства ресурса из реестра,
+// для allprop к ним добавляются свойства из include
+func (this *XML_Request) Resolve(resource int) (props XML_Properties) {
+	if this.AllProp == nil && this.PropName == nil {
+		return this.Properties
+	}
+
+	for _, item := range KnownProperties() {
+		if item.Applies(resource) && (this.PropName != nil || item.AllProp()) {
+			props = append(props, item)
+		}
+	}
+
+	if this.PropName != nil {
+		return
+	}
+
+	for _, item := range this.Include {
+		if props.Get(item.Name()) == nil {
+			props = append(props, item)
+		}
+	}
+
+	return
+}
+
+// Добавь в ответ свойства ресурса ctx.Href или только
+// их имена, если клиент запросил propname
+func (this *XML_Request) Describe(multi *Multistatus_XML_Response, ctx *ContextAdapter) {
+	var props = this.Resolve(ctx.Resource)
+
+	if this.PropName != nil {
+		props.EachName(multi, ctx)
+		return
+	}
+
+	props.Each(multi, ctx)
+}
+
 func (this *XML_Elements) Add(el XML_Element) {
 	this.Items = append(this.Items, el)
 }
 
+// Добавь свойство в группу propstat с тем же результатом
+func (this *XML_Response) AddProperty(el XML_Element) {
+	var (
+		stat *Propstat_XML_Response
+	)
+
+	if el.Status == 0 {
+		el.Status = http.StatusOK
+	}
+
+	for _, item := range this.Propstats {
+		if item.Status.value == el.Status && item.Description == el.Error &&
+			item.condition == el.Condition {
+			stat = item
+			break
+		}
+	}
+
+	if stat == nil {
+		stat = &Propstat_XML_Response{
+			Properties:  &XML_Elements{},
+			Status:      Status_XML_Response{el.Status},
+			Description: el.Error,
+			condition:   el.Condition,
+		}
+
+		if el.Condition != "" {
+			stat.Error = NewXmlConditionElement(el.Condition)
+		}
+
+		this.Propstats = append(this.Propstats, stat)
+	}
+
+	// Значение свойства с ошибкой клиенту не передается
+	if el.Status != http.StatusOK {
+		el.Data = nil
+		el.Text = nil
+	}
+
+	stat.Properties.Add(el)
+}
+
+// Собери свойства ресурса ctx.Href в один ответ, сгруппировав
+// их по фактическому результату вычисления
 func (this *XML_Properties) Each(multi *Multistatus_XML_Response, ctx *ContextAdapter) {
 	var (
-		resp = make(map[int]*XML_Elements)
+		resp = &XML_Response{
+			Href: ctx.Href,
+		}
 	)
 
 	for _, item := range *this {
-		ctx.Debug("Processing property: %s status(%d)", item.Name(), item.Status())
+		el := item.XmlElem(ctx)
 
-		if _, ok := resp[item.Status()]; !ok {
-			resp[item.Status()] = &XML_Elements{}
-		}
+		ctx.Debug("Processing property: %s status(%d)", item.Name(), el.Status)
 
-		resp[item.Status()].Add(item.XmlElem(ctx))
+		resp.AddProperty(el)
 	}
 
-	for s, items := range resp {
-		r := multi.AddResponse(s, items)
+	multi.Responses = append(multi.Responses, resp)
+}
+
+// Собери имена свойств ресурса ctx.Href без значений
+func (this *XML_Properties) EachName(multi *Multistatus_XML_Response, ctx *ContextAdapter) {
+	var (
+		resp = &XML_Response{
+			Href: ctx.Href,
+		}
+	)
 
-		if r.Status.value == 200 {
-			r.Href = ctx.Href
+	for _, item := range *this {
+		if item.Applies(ctx.Resource) {
+			resp.AddProperty(NewXmlElement(item.Prefix()+item.Name(), nil))
 		}
 	}
+
+	multi.Responses = append(multi.Responses, resp)
 }
 
 func (this *XML_Property) Name() string {
@@ -270,54 +462,36 @@ func (this *XML_Property) Status() int {
 	return this.XmlStatus
 }
 
-func (this *XML_Property) XmlElem(ctx *ContextAdapter) XML_Element {
-	return XML_Element{
-		XMLName: xml.Name{
-			Local: this.Prefix() + this.Name(),
-		},
-		Status: 200,
-		Data:   this.XmlInner,
-	}
+// Неизвестное свойство не найдено ни у одного ресурса
+func (this *XML_Property) Applies(resource int) bool {
+	return false
 }
 
-func (this *CTag_XML_Property) Name() string {
-	return this.XmlName
+func (this *XML_Property) AllProp() bool {
+	return false
 }
 
-func (this *CTag_XML_Property) Prefix() string {
-	if this.XmlNsPrefix != "" {
-		return this.XmlNsPrefix + ":"
+func (this *XML_Property) XmlElem(ctx *ContextAdapter) XML_Element {
+	var name = xml.Name{
+		Local: this.Prefix() + this.Name(),
 	}
 
-	return this.XmlNsPrefix
-}
+	if this.XmlNsPrefix == "" {
+		name.Space = this.XmlNamespace
+	}
 
-func (this *CTag_XML_Property) Status() int {
-	return this.XmlStatus
+	return XML_Element{
+		XMLName: name,
+		Status:  this.Status(),
+		Data:    this.XmlInner,
+	}
 }
 
-func (this *CTag_XML_Property) XmlElem(ctx *ContextAdapter) XML_Element {
-	var (
-		err  error
-		etag *ClientsETag
-
-		elem = XML_Element{
-			XMLName: xml.Name{
-				Local: this.Prefix() + this.Name(),
-			},
-			Status: 200,
-		}
-	)
-
-	if etag, err = ctx.GetClientsETag(ctx.User, ctx.Password); err != nil {
-		ctx.Error(err)
-
-		elem.Error = "Internal server error"
-		elem.Status = 500
-		return elem
-	}
+// Экранируй текст для вставки в XML
+func escapeText(s string) []byte {
+	var buff = bytes.NewBuffer(nil)
 
-	elem.Data = []byte(`"` + etag.ETag + `"`)
+	xml.EscapeText(buff, []byte(s))
 
-	return elem
+	return buff.Bytes()
 }
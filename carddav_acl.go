@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Привилегии пользователя на ресурс, RFC 3744 3. Адресная книга
+// доступна только для чтения, если не разрешено изменение
+// контактов (-W) и их удаление (-D)
+func userPrivileges(resource int) (list []string) {
+	list = []string{"d:read"}
+
+	if !ALLOWWRITE {
+		return
+	}
+
+	switch resource {
+	case ResourceContact:
+		list = append(list, "d:write-content")
+
+	case ResourceCollection:
+		list = append(list, "d:write-content")
+
+		if ALLOWDELETE {
+			list = append(list, "d:unbind")
+		}
+	}
+
+	return
+}
+
+// Собери элементы DAV:privilege
+func privilegesXml(list []string) []byte {
+	var buff = make([]byte, 0, 64*len(list))
+
+	for _, item := range list {
+		buff = append(buff, "<d:privilege><"+item+"/></d:privilege>"...)
+	}
+
+	return buff
+}
+
+// Ошибка недостатка привилегий на ресурс, RFC 3744 7.1.1
+func NewPrivilegeError(href, privilege string) *DAV_Error {
+	var err = NewDAVError(http.StatusForbidden, "d:need-privileges")
+
+	err.Content = []byte("<d:resource><d:href>" + string(escapeText(href)) + "</d:href>" +
+		string(privilegesXml([]string{privilege})) + "</d:resource>")
+
+	return err
+}
+
+// Адрес коллекции, в которой находится ресурс
+func parentHref(href string) string {
+	if href = path.Dir(strings.TrimSuffix(href, "/")); href == "/" {
+		return href
+	}
+
+	return href + "/"
+}
+
+func init() {
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "current-user-privilege-set",
+		Resources: AllResources,
+		Explicit:  true,
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			return privilegesXml(userPrivileges(ctx.Resource)), nil
+		},
+	})
+
+	// Права задаются настройками сервера и не могут быть изменены
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "acl",
+		Resources: AllResources,
+		Explicit:  true,
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			var href, _ = principalHref(ctx)
+
+			return []byte("<d:ace><d:principal>" + string(href) + "</d:principal><d:grant>" +
+				string(privilegesXml(userPrivileges(ctx.Resource))) +
+				"</d:grant><d:protected/></d:ace>"), nil
+		},
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Фильтр запроса addressbook-query, RFC 6352 10.5
+type Filter_XML_Request struct {
+	Test  string                    `xml:"test,attr"`
+	Props []*PropFilter_XML_Request `xml:"prop-filter"`
+}
+
+// Условие на свойство vCard
+type PropFilter_XML_Request struct {
+	Name         string                   `xml:"name,attr"`
+	Test         string                   `xml:"test,attr"`
+	IsNotDefined *struct{}                `xml:"is-not-defined"`
+	TextMatch    []*TextMatch_XML_Request `xml:"text-match"`
+}
+
+// Сравнение значения свойства с текстом
+type TextMatch_XML_Request struct {
+	Collation string `xml:"collation,attr"`
+	MatchType string `xml:"match-type,attr"`
+	Negate    string `xml:"negate-condition,attr"`
+	Value     string `xml:",chardata"`
+}
+
+// Свойства vCard, по которым можно искать, и их значения у клиента SBSS
+var Filter_Properties = map[string]func(*User) []string{
+	"FN": func(u *User) []string {
+		return []string{u.Name}
+	},
+
+	"EMAIL": func(u *User) []string {
+		if u.Email == nil {
+			return nil
+		}
+
+		return []string{u.Email.Value}
+	},
+
+	"ORG": func(u *User) []string {
+		return []string{u.Organization}
+	},
+
+	"CATEGORIES": func(u *User) []string {
+		return []string{u.Classname}
+	},
+}
+
+// Проверь, что фильтр можно выполнить: известны все свойства,
+// правила сравнения и типы совпадения
+func (this *Filter_XML_Request) Validate() error {
+	for _, prop := range this.Props {
+		if _, ok := Filter_Properties[strings.ToUpper(prop.Name)]; !ok {
+			return NewDAVError(http.StatusForbidden, "card:supported-filter")
+		}
+
+		for _, text := range prop.TextMatch {
+			switch text.Collation {
+			case "", "i;unicode-casemap", "i;ascii-casemap", "i;octet":
+			default:
+				return NewDAVError(http.StatusForbidden, "card:supported-collation")
+			}
+
+			switch text.MatchType {
+			case "", "equals", "contains", "starts-with", "ends-with":
+			default:
+				return NewDAVError(http.StatusForbidden, "card:supported-filter")
+			}
+		}
+	}
+
+	return nil
+}
+
+// Примени фильтр к клиенту SBSS
+func (this *Filter_XML_Request) Match(u *User) bool {
+	if this == nil || len(this.Props) == 0 {
+		return true
+	}
+
+	return matchTest(this.Test, len(this.Props), func(i int) bool {
+		return this.Props[i].Match(u)
+	})
+}
+
+// Перенеси условия фильтра в запрос к SBSS, где это возможно.
+// Результат все равно проверяется фильтром, поэтому поиск на
+// стороне SBSS должен лишь сократить выборку
+func (this *Filter_XML_Request) Request(filter *ClientsRequest) {
+	var prop *PropFilter_XML_Request
+
+	if this == nil || len(this.Props) == 0 {
+		return
+	}
+
+	// При anyof поиск по одному условию отсечет подходящие по другим
+	if len(this.Props) > 1 && this.Test != "allof" {
+		return
+	}
+
+	for _, item := range this.Props {
+		switch strings.ToUpper(item.Name) {
+		case "FN", "EMAIL":
+			if len(item.TextMatch) == 1 && item.IsNotDefined == nil {
+				prop = item
+			}
+		}
+
+		if prop != nil {
+			break
+		}
+	}
+
+	if prop == nil {
+		return
+	}
+
+	if text := prop.TextMatch[0]; text.Negate != "yes" && strings.TrimSpace(text.Value) != "" {
+		filter.Search = strings.TrimSpace(text.Value)
+	}
+}
+
+func (this *PropFilter_XML_Request) Match(u *User) (ok bool) {
+	var (
+		values []string
+	)
+
+	for _, v := range Filter_Properties[strings.ToUpper(this.Name)](u) {
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+
+	if this.IsNotDefined != nil {
+		return len(values) == 0
+	}
+
+	if len(this.TextMatch) == 0 {
+		return len(values) > 0
+	}
+
+	return matchTest(this.Test, len(this.TextMatch), func(i int) bool {
+		return this.TextMatch[i].Match(values)
+	})
+}
+
+// Проверь значения свойства, совпадение хотя бы с одним
+// значением считается совпадением свойства
+func (this *TextMatch_XML_Request) Match(values []string) (ok bool) {
+	var (
+		text = this.fold(this.Value)
+	)
+
+	for _, v := range values {
+		v = this.fold(v)
+
+		switch this.MatchType {
+		case "equals":
+			ok = v == text
+
+		case "starts-with":
+			ok = strings.HasPrefix(v, text)
+
+		case "ends-with":
+			ok = strings.HasSuffix(v, text)
+
+		default:
+			ok = strings.Contains(v, text)
+		}
+
+		if ok {
+			break
+		}
+	}
+
+	if this.Negate == "yes" {
+		return !ok
+	}
+
+	return
+}
+
+// Приведи строку к виду для сравнения согласно collation
+func (this *TextMatch_XML_Request) fold(s string) string {
+	switch this.Collation {
+	case "i;octet":
+		return s
+
+	case "i;ascii-casemap":
+		return strings.Map(func(r rune) rune {
+			if r >= 'A' && r <= 'Z' {
+				return r + ('a' - 'A')
+			}
+			return r
+		}, s)
+	}
+
+	return strings.ToLower(s)
+}
+
+// Объедини результаты условий согласно атрибуту test,
+// по умолчанию anyof
+func matchTest(test string, n int, fn func(int) bool) bool {
+	if test == "allof" {
+		for i := 0; i < n; i++ {
+			if !fn(i) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	for i := 0; i < n; i++ {
+		if fn(i) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"encoding/xml"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func HandlePropfind(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
@@ -17,52 +19,143 @@ func HandlePropfind(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter)
 
 		req   = XML_Request{}
 		multi = NewMultiStatus()
+		depth = r.Header.Get("Depth")
 	)
 
 	defer r.Body.Close()
 
 	if ctx.Href == "" {
-		ctx.Href = r.URL.RequestURI()
+		ctx.Href = ctx.URL.External(r.URL.RequestURI())
 
 		ctx.Debug("Empty context Href property overwrited to: %s", ctx.Href)
 	}
 
+	switch depth {
+	case "0", "1":
+
+	case "":
+		// По RFC 4918 отсутствие заголовка означает infinity, но
+		// клиенты, которые его не передают, ждут ответ по ресурсу
+		ctx.Debug("Depth header is missing, assume 0")
+		depth = "0"
+
+	default:
+		ctx.Warn("Unsupported depth: %s", depth)
+
+		sentBytes, _ = NewDAVError(http.StatusForbidden, "d:propfind-finite-depth").Write(w)
+		ctx.Notice("Sent %d bytes", sentBytes)
+		return
+	}
+
 	if body, err = ioutil.ReadAll(r.Body); err != nil {
 		ctx.Error(err)
 		return
 	}
 
+	// Пустой запрос равнозначен allprop, RFC 4918 9.1
 	if len(body) == 0 {
-		ctx.Warn("Empty request")
+		req.AllProp = &struct{}{}
+	} else if err = xml.Unmarshal(body, &req); err != nil {
+		ctx.Error(err)
 
-		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	if err = xml.Unmarshal(body, &req); err != nil {
+	multi.Stream(w)
+	req.Describe(&multi, ctx)
+
+	if depth == "1" {
+		if err = PropfindMembers(&req, &multi, ctx); err != nil {
+			sentBytes, _ = NewSbssError(err).Write(w)
+			ctx.Notice("Sent %d bytes", sentBytes)
+			return
+		}
+	}
+
+	if sentBytes, err = multi.Close(); err != nil {
 		ctx.Error(err)
+	}
+
+	ctx.Notice("Sent %d bytes", sentBytes)
+}
 
+// Отдай свойства контакта книги. Вложенных ресурсов у
+// контакта нет, поэтому Depth: 1 вернет только его свойства
+func HandlePropfindContact(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+	var (
+		code int
+		item *User
+	)
+
+	if item, code = findBookContact(ctx); item == nil {
+		WriteStatus(w, code)
 		return
 	}
 
-	if v := req.Get("getetag"); v != nil {
-		ctx.Href = "/carddav/contacts"
-	}
+	ctx.Resource = ResourceContact
+	ctx.Contact = item
+	ctx.Href = ctx.URL.External(r.URL.Path)
 
-	req.Properties.Each(&multi, ctx)
+	HandlePropfind(w, r, ctx)
+}
 
-	// Re-use body
-	body = make([]byte, 0)
+// Отдай свойства ресурса пользователя, ресурсы других
+// пользователей недоступны
+func HandlePrincipal(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+	if login := ctx.Params.ByName("login"); login != ctx.User {
+		ctx.Warn("Principal %s is not available for %s", login, ctx.User)
 
-	if body, err = xml.Marshal(multi); err != nil {
-		ctx.Error(err)
+		w.WriteHeader(http.StatusForbidden)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-	w.WriteHeader(http.StatusMultiStatus)
+	HandlePropfind(w, r, ctx)
+}
 
-	sentBytes, _ = w.Write(body)
-	ctx.Notice("Sent %d bytes", sentBytes)
+// Перенаправь запрос к well-known адресу на контекстный
+// путь сервиса, RFC 6764 5
+func HandleWellKnown(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+	http.Redirect(w, r, ctx.URL.Absolute(ctx.URL.Home()), http.StatusMovedPermanently)
+}
+
+// Добавь в ответ PROPFIND с Depth: 1 ресурсы коллекции: для
+// домашней коллекции это адресная книга, для адресной книги
+// контакты
+func PropfindMembers(req *XML_Request, multi *Multistatus_XML_Response, ctx *ContextAdapter) (err error) {
+	var (
+		clients *ClientsList
+	)
+
+	switch ctx.Resource {
+	case ResourceHome:
+		if clients, err = (&AddressBook{}).Clients(ctx, nil); err != nil {
+			ctx.Error(err)
+
+			return NewSbssError(err)
+		}
+
+		ctx.Resource = ResourceCollection
+
+		for _, book := range AddressBooks(clients.Users) {
+			ctx.Book = book
+			ctx.Href = ctx.URL.Book(book)
+
+			req.Describe(multi, ctx)
+		}
+
+	case ResourceCollection:
+		if clients, err = contextBook(ctx).Clients(ctx, nil); err != nil {
+			ctx.Error(err)
+
+			return NewSbssError(err)
+		}
+
+		for _, item := range bookContacts(clients.Users) {
+			describeContact(req, multi, ctx, item, ctx.URL.Contact(contextBook(ctx), item))
+		}
+	}
+
+	return nil
 }
 
 func HandleReport(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
@@ -71,15 +164,18 @@ func HandleReport(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
 		err       error
 		sentBytes int
 
-		req = XML_Request{}
-
-		multi = Multistatus_XML_Response{
-			XmlnsDAV:  "DAV:",
-			XmlnsCard: "urn:ietf:params:xml:ns:carddav",
-			XmlnsCS:   "http://calendarserver.org/ns/",
-		}
+		req   = XML_Request{}
+		multi = NewMultiStatus()
 	)
 
+	defer r.Body.Close()
+
+	if ctx.Href == "" {
+		ctx.Href = ctx.URL.External(r.URL.RequestURI())
+
+		ctx.Debug("Empty context Href property overwrited to: %s", ctx.Href)
+	}
+
 	if body, err = ioutil.ReadAll(r.Body); err != nil {
 		ctx.Error(err)
 		return
@@ -88,7 +184,7 @@ func HandleReport(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
 	if len(body) == 0 {
 		ctx.Warn("Empty request")
 
-		w.WriteHeader(http.StatusNoContent)
+		WriteStatus(w, http.StatusBadRequest)
 		return
 	}
 
@@ -98,153 +194,718 @@ func HandleReport(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
 		return
 	}
 
+	switch req.XMLName.Local {
+	case "sync-collection", "addressbook-multiget", "addressbook-query":
+
+	default:
+		ctx.Warn("Unsupported report: %s", req.XMLName.Local)
+
+		sentBytes, _ = NewDAVError(http.StatusForbidden, "d:supported-report").Write(w)
+		ctx.Notice("Sent %d bytes", sentBytes)
+		return
+	}
+
+	if err = requestAddressData(&req, ctx); err != nil {
+		ctx.Warn("Unsupported address data: %s", err.Error())
+
+		sentBytes, _ = NewSbssError(err).Write(w)
+		ctx.Notice("Sent %d bytes", sentBytes)
+		return
+	}
+
+	multi.Stream(w)
+
 	switch req.XMLName.Local {
 	case "sync-collection":
-		SyncCollection(&req, &multi, ctx)
+		err = SyncCollection(&req, &multi, ctx)
 
 	case "addressbook-multiget":
-		MultiGet(&req, &multi, ctx)
+		err = MultiGet(&req, &multi, ctx)
+
+	case "addressbook-query":
+		err = AddressbookQuery(&req, &multi, ctx)
 	}
 
-	// Re-use body
-	body = make([]byte, 0)
+	if err != nil {
+		e := NewSbssError(err)
+		ctx.Warn("Report failed: %s", e.Error())
 
-	if body, err = xml.Marshal(multi); err != nil {
-		ctx.Error(err)
+		sentBytes, _ = e.Write(w)
+		ctx.Notice("Sent %d bytes", sentBytes)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-	w.WriteHeader(http.StatusMultiStatus)
+	if sentBytes, err = multi.Close(); err != nil {
+		ctx.Error(err)
+	}
 
-	sentBytes, _ = w.Write(body)
 	ctx.Notice("Sent %d bytes", sentBytes)
 }
 
-func SyncCollection(req *XML_Request, multi *Multistatus_XML_Response, ctx *ContextAdapter) {
+// Отдай изменения коллекции с момента выдачи sync-token, RFC 6578.
+// Без токена клиент получит все контакты коллекции
+func SyncCollection(req *XML_Request, multi *Multistatus_XML_Response, ctx *ContextAdapter) (err error) {
 	var (
-		contenttype bool
-		clients     *ClientsList
-		elem        *XML_Elements
-		err         error
+		count   int
+		clients *ClientsList
+		prev    *SyncSnapshot
+		changed []*User
+
+		items = make(map[string]string)
+		state = make(map[string]string)
+		limit = syncLimit(req.Limit)
 	)
 
-	if v := req.Get("getcontenttype"); v != nil {
-		contenttype = true
+	if req.SyncToken != "" {
+		if prev = ctx.Tokens.Get(ctx.User, ctx.Href, req.SyncToken); prev == nil {
+			return NewDAVError(http.StatusForbidden, "d:valid-sync-token")
+		}
+
+		for href, etag := range prev.items {
+			state[href] = etag
+		}
 	}
 
-	if clients, err = ctx.GetClients(ctx.User, ctx.Password, nil); err != nil {
+	if clients, err = contextBook(ctx).Clients(ctx, nil); err != nil {
 		ctx.Error(err)
 
-		return
+		return NewSbssError(err)
+	}
+
+	for _, item := range bookContacts(clients.Users) {
+		href := ctx.URL.Contact(contextBook(ctx), item)
+		items[href] = item.ETag()
+
+		if prev == nil || prev.Modified(href, items[href]) {
+			changed = append(changed, item)
+		}
+	}
+
+	// Порядок страниц не должен зависеть от порядка ответа SBSS
+	sort.Slice(changed, func(i, j int) bool {
+		return ctx.URL.Contact(contextBook(ctx), changed[i]) < ctx.URL.Contact(contextBook(ctx), changed[j])
+	})
+
+	for _, item := range changed {
+		if limit > 0 && count == limit {
+			break
+		}
+
+		href := ctx.URL.Contact(contextBook(ctx), item)
+
+		describeContact(req, multi, ctx, item, href)
+
+		state[href] = items[href]
+		count++
 	}
 
-	for _, item := range clients.Users {
-		elem = &XML_Elements{}
+	if prev != nil {
+		for _, href := range prev.Removed(items) {
+			if limit > 0 && count == limit {
+				break
+			}
 
-		elem.Add(NewXmlElement(
-			"d:getetag",
-			[]byte(`"`+strconv.FormatInt(item.Updated.Unix(), 10)+`"`),
-		))
+			multi.AddStatusResponse(href, http.StatusNotFound)
 
-		if contenttype {
-			elem.Add(NewXmlElement(
-				"d:getcontenttype",
-				[]byte("text/vcard"),
-			))
+			delete(state, href)
+			count++
 		}
+	}
 
-		resp := multi.AddResponse(200, elem)
-		resp.Href = "/carddav/" + item.Uid + ".vcf"
+	// Ответ усечен, RFC 6578 3.6: токен описывает только отданные
+	// изменения, остальные клиент получит следующим запросом
+	if limit > 0 && count == limit && !syncComplete(state, items) {
+		multi.AddLimitResponse(ctx.Href)
 	}
 
-	multi.Token = RandStringId(16)
+	multi.Token = ctx.Tokens.Put(ctx.User, ctx.Href, state)
+
+	return nil
 }
 
-func MultiGet(req *XML_Request, multi *Multistatus_XML_Response, ctx *ContextAdapter) {
+// Наибольшее число изменений в ответе sync-collection с учетом
+// DAV:limit клиента и ограничения сервера, 0 - без ограничения
+func syncLimit(limit int) int {
+	if SYNCLIMIT > 0 && (limit <= 0 || limit > SYNCLIMIT) {
+		return SYNCLIMIT
+	}
+
+	if limit < 0 {
+		return 0
+	}
+
+	return limit
+}
+
+// Проверь, что клиент получил все изменения коллекции
+func syncComplete(state, items map[string]string) bool {
+	var snapshot = SyncSnapshot{items: state}
+
+	return snapshot.equal(items)
+}
+
+// Отдай контакты по списку href из запроса, RFC 6352 8.7.
+// Клиенты запрашиваются у SBSS одним запросом по идентификаторам
+// из имен ресурсов, группы - по клиентам своего класса. Контакты
+// вне запрошенной книги не отдаются
+func MultiGet(req *XML_Request, multi *Multistatus_XML_Response, ctx *ContextAdapter) (err error) {
 	var (
 		clients *ClientsList
-		buff    *bytes.Buffer
-		elem    *XML_Elements
-		err     error
+		code    int
+
+		book   = contextBook(ctx)
+		ids    = make([]string, 0, len(req.Hrefs))
+		found  = make(map[int]*User)
+		groups = make(map[int]*User)
+		filter = &ClientsRequest{}
+	)
+
+	for _, href := range req.Hrefs {
+		if id := contactId(href); id > 0 {
+			ids = append(ids, strconv.Itoa(id))
+		} else if id = groupId(href); id > 0 && groups[id] == nil {
+			if groups[id], code = findGroup(ctx, id); code != http.StatusOK && code != http.StatusNotFound {
+				return NewDAVError(code, "")
+			}
+		}
+	}
+
+	switch len(ids) {
+	case 0:
+		ctx.Debug("No contacts requested")
+
+	case 1:
+		filter.Contacts = 1
+		filter.Uid, _ = strconv.Atoi(ids[0])
+
+	default:
+		filter.Ids = strings.Join(ids, ",")
+	}
+
+	if len(ids) > 0 {
+		if clients, err = (&AddressBook{}).Clients(ctx, filter); err != nil {
+			ctx.Error(err)
+
+			return NewSbssError(err)
+		}
+
+		for _, item := range clients.Users {
+			found[item.Id] = item
+		}
+	}
+
+	for _, href := range req.Hrefs {
+		item, ok := found[contactId(href)]
+
+		if id := groupId(href); id > 0 {
+			item, ok = groups[id], groups[id] != nil
+		}
+
+		if !ok || !book.Contains(item) {
+			ctx.Debug("Contact %s not found", href)
+
+			multi.AddStatusResponse(href, http.StatusNotFound)
+			continue
+		}
+
+		describeContact(req, multi, ctx, item, href)
+	}
+
+	return nil
+}
+
+// Найди контакты по фильтру addressbook-query, RFC 6352 8.6
+func AddressbookQuery(req *XML_Request, multi *Multistatus_XML_Response, ctx *ContextAdapter) (err error) {
+	var (
+		clients *ClientsList
+		all     *ClientsList
+		groups  []*User
+		count   int
+
+		filter = &ClientsRequest{}
 	)
 
-	if clients, err = ctx.GetClients(ctx.User, ctx.Password, nil); err != nil {
+	if req.Filter != nil {
+		if err = req.Filter.Validate(); err != nil {
+			return
+		}
+
+		req.Filter.Request(filter)
+	} else if req.Limit > 0 {
+		// Без фильтра ограничение можно передать в SBSS,
+		// запросим на один больше, чтобы узнать об усечении
+		filter.Limit = req.Limit + 1
+	}
+
+	ctx.Debug("Query filter: %+v", filter)
+
+	if clients, err = contextBook(ctx).Clients(ctx, filter); err != nil {
 		ctx.Error(err)
 
-		return
+		return NewSbssError(err)
 	}
 
-	for _, item := range clients.Users {
-		elem = &XML_Elements{}
-		buff = bytes.NewBuffer(nil)
+	groups = ContactGroups(clients.Users)
+
+	// Поиск SBSS отсекает часть участников групп, группы
+	// собираются по всем клиентам книги
+	if filter.Search != "" {
+		if all, err = contextBook(ctx).Clients(ctx, nil); err != nil {
+			ctx.Error(err)
 
-		elem.Add(NewXmlElement(
-			"d:getetag",
-			[]byte(`"`+strconv.FormatInt(item.Updated.Unix(), 10)+`"`),
-		))
+			return NewSbssError(err)
+		}
+
+		groups = ContactGroups(all.Users)
+	}
 
-		if err = xml.EscapeText(buff, EncodeWrap(item)); err != nil {
-			ctx.Error("Can't encode item: %+v", item)
+	for _, item := range append(clients.Users[:len(clients.Users):len(clients.Users)], groups...) {
+		if !req.Filter.Match(item) {
 			continue
 		}
 
-		elem.Add(NewXmlElement(
-			"card:address-data",
-			buff.Bytes(),
-		))
+		if req.Limit > 0 && count == req.Limit {
+			multi.AddLimitResponse(ctx.Href)
+			break
+		}
+
+		describeContact(req, multi, ctx, item, ctx.URL.Contact(contextBook(ctx), item))
+
+		count++
+	}
+
+	return nil
+}
+
+// Получи идентификатор клиента SBSS из href или имени ресурса
+// контакта client-<id>.vcf или прежнего uuid-<id>.vcf
+func contactId(href string) (id int) {
+	if idx := strings.LastIndex(href, "/"); idx > -1 {
+		href = href[idx+1:]
+	}
 
-		resp := multi.AddResponse(200, elem)
-		resp.Href = "/carddav/contacts/" + item.Uid + ".vcf"
+	href = strings.TrimSuffix(href, ".vcf")
+
+	for _, prefix := range []string{ContactNamePrefix, LegacyUidPrefix} {
+		if strings.HasPrefix(href, prefix) {
+			id, _ = strconv.Atoi(strings.TrimPrefix(href, prefix))
+			break
+		}
 	}
+
+	return
+}
+
+// Добавь в ответ запрошенные свойства контакта, адрес и тип
+// ресурса контекста восстанавливаются после ответа
+func describeContact(req *XML_Request, multi *Multistatus_XML_Response, ctx *ContextAdapter, item *User, href string) {
+	var (
+		resource = ctx.Resource
+		parent   = ctx.Href
+	)
+
+	ctx.Resource = ResourceContact
+	ctx.Contact = item
+	ctx.Href = href
+
+	req.Describe(multi, ctx)
+
+	ctx.Resource = resource
+	ctx.Contact = nil
+	ctx.Href = parent
+
+	// Ошибка записи вернется клиенту при завершении ответа
+	multi.Flush()
 }
 
 func HandleGetContact(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
 	var (
-		uid       int
-		filter    *ClientsRequest
-		clients   *ClientsList
+		code      int
+		item      *User
 		sentBytes int
+		format    *AddressDataType
+	)
+
+	if item, code = findBookContact(ctx); item == nil {
+		WriteStatus(w, code)
+		return
+	}
+
+	if format = NegotiateAddressData(r.Header.Get("Accept")); format == nil {
+		ctx.Warn("Not acceptable: %s", r.Header.Get("Accept"))
+
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("ETag", format.ETag(item))
+
+	if !item.Updated.IsZero() {
+		w.Header().Set("Last-Modified", item.Updated.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, item, format) {
+		ctx.Debug("Contact %s is not modified", item.Uid)
+
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.MimeType())
+
+	sentBytes, _ = w.Write(format.Encode(item, nil))
+	ctx.Notice("Sent %d bytes", sentBytes)
+}
+
+// Отдай всю адресную книгу, если имя в пути соответствует книге,
+// иначе контакт по прежнему адресу /carddav/<имя>
+func HandleGetResource(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+	if ctx.Book = ParseAddressBook(ctx.Params.ByName("book")); ctx.Book != nil {
+		ctx.Href = ctx.URL.Book(ctx.Book)
+		ctx.Resource = ResourceCollection
+
+		HandleExportBook(w, r, ctx)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/") {
+		ctx.Warn("Unknown address book: %s", ctx.Params.ByName("book"))
+
+		http.NotFound(w, r)
+		return
+	}
+
+	HandleGetContact(w, r, ctx)
+}
+
+// Выгрузи клиентов адресной книги одним файлом: vCard следуют
+// друг за другом, jCard передаются массивом, RFC 7095 3.3
+func HandleExportBook(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+	var (
 		err       error
+		n         int
+		sentBytes int
+		clients   *ClientsList
+		users     []*User
+		format    *AddressDataType
+		book      = contextBook(ctx)
+		ext       = ".vcf"
 	)
 
-	w.Header().Set("Contact-type", "text/x-vcard; charset=utf-8")
+	if format = NegotiateAddressData(r.Header.Get("Accept")); format == nil {
+		ctx.Warn("Not acceptable: %s", r.Header.Get("Accept"))
+
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	if clients, err = book.Clients(ctx, nil); err != nil {
+		ctx.Error(err)
+
+		sentBytes, _ = NewSbssError(err).Write(w)
+		ctx.Notice("Sent %d bytes", sentBytes)
+		return
+	}
+
+	if format.ContentType == MimeJCard {
+		ext = ".json"
+	}
+
+	users = bookContacts(clients.Users)
+
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Type", format.MimeType())
+	w.Header().Set("Content-Disposition", `attachment; filename="`+book.Name()+ext+`"`)
+
+	if format.ContentType == MimeJCard {
+		n, _ = w.Write([]byte("["))
+		sentBytes += n
+	}
+
+	for i, item := range users {
+		if i > 0 && format.ContentType == MimeJCard {
+			n, _ = w.Write([]byte(","))
+			sentBytes += n
+		}
+
+		n, _ = w.Write(format.Encode(item, nil))
+		sentBytes += n
+	}
 
-	uid, _ = strconv.Atoi(
-		strings.TrimSuffix(
-			strings.TrimPrefix(ctx.Params.ByName("contact"), "uuid-"),
-			".vcf",
-		),
+	if format.ContentType == MimeJCard {
+		n, _ = w.Write([]byte("]"))
+		sentBytes += n
+	}
+
+	ctx.Notice("Exported %d contacts of %s, sent %d bytes", len(users), book.Name(), sentBytes)
+}
+
+// Сохрани изменения контакта из vCard в SBSS. Переносятся
+// только FN, ORG и EMAIL, создание новых клиентов не поддерживается
+func HandlePutContact(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+	var (
+		body []byte
+		err  error
+		uid  int
+		code int
+		item *User
+		card userCardUpload
+		res  *ClientsResponse
 	)
 
-	if uid == 0 {
-		ctx.Error("Can't get user id from url %s", r.URL.RequestURI())
-		w.WriteHeader(http.StatusNotFound)
+	defer r.Body.Close()
+
+	if !ALLOWWRITE {
+		ctx.Warn("Contact changes are not allowed")
+		NewPrivilegeError(ctx.URL.External(r.URL.Path), "d:write-content").Write(w)
 		return
 	}
 
-	filter = &ClientsRequest{
-		Contacts: 1,
-		Uid:      uid,
+	if !isContactName(contactName(ctx)) {
+		ctx.Warn("Creating contacts is not supported: %s", r.URL.RequestURI())
+		NewPrivilegeError(parentHref(ctx.URL.External(r.URL.Path)), "d:bind").Write(w)
+		return
 	}
 
-	if clients, err = ctx.GetClients(ctx.User, ctx.Password, filter); err != nil {
+	if item, code = findBookContact(ctx); item == nil && code != http.StatusNotFound {
+		WriteStatus(w, code)
+		return
+	}
+
+	if code = checkPreconditions(r, item); code != 0 {
+		ctx.Warn("Precondition failed for contact %s", contactName(ctx))
+		WriteStatus(w, code)
+		return
+	}
+
+	if item == nil {
+		ctx.Warn("Creating contacts is not supported: %s", r.URL.RequestURI())
+		NewPrivilegeError(parentHref(ctx.URL.External(r.URL.Path)), "d:bind").Write(w)
+		return
+	}
+
+	uid = item.Id
+
+	if t := r.Header.Get("Content-Type"); t != "" &&
+		!strings.HasPrefix(t, "text/vcard") && !strings.HasPrefix(t, "text/x-vcard") {
+		NewDAVError(http.StatusForbidden, "card:supported-address-data").Write(w)
+		return
+	}
+
+	if body, err = ioutil.ReadAll(io.LimitReader(r.Body, MaxResourceSize+1)); err != nil {
 		ctx.Error(err)
-		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	if !clients.Success && clients.Error != "" {
-		ctx.Error(clients.Error)
-		w.WriteHeader(http.StatusForbidden)
+	if len(body) > MaxResourceSize {
+		ctx.Warn("vCard exceeds %d bytes", MaxResourceSize)
+		NewDAVError(http.StatusForbidden, "card:max-resource-size").Write(w)
 		return
 	}
 
-	if len(clients.Users) == 0 {
-		ctx.Error("Can't get user by id %d", uid)
+	if err = Unmarshal(body, &card); err != nil {
+		ctx.Warn("Can't parse vCard: %s", err)
+		NewDAVError(http.StatusForbidden, "card:valid-address-data").Write(w)
+		return
+	}
+
+	item.Apply(&card)
+
+	if res, err = ctx.SetClient(ctx.User, ctx.Password, item); err != nil {
+		ctx.Error(err)
+		WriteStatus(w, NewSbssError(err).Code)
+		return
+	}
+
+	if !res.Success {
+		ctx.Error("Can't save client %d: %s", uid, res.Error)
+		WriteStatus(w, NewSbssError(&SbssResponseError{res.Challenge, res.Error}).Code)
+		return
+	}
+
+	ctx.Notice("Contact %d saved", uid)
+
+	// SBSS хранит только часть свойств карточки, сохраненная версия
+	// отличается от загруженной, поэтому ETag не передается и клиент
+	// получит карточку заново, RFC 6352 6.3.2.3
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Удали клиента в SBSS, если это разрешено настройками
+func HandleDeleteContact(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+	var (
+		err  error
+		uid  int
+		code int
+		item *User
+		res  *ClientsResponse
+	)
+
+	if !ALLOWWRITE || !ALLOWDELETE {
+		ctx.Warn("Contact removal is not allowed")
+		NewPrivilegeError(parentHref(ctx.URL.External(r.URL.Path)), "d:unbind").Write(w)
+		return
+	}
+
+	if !isContactName(contactName(ctx)) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	sentBytes, _ = w.Write(EncodeWrap(clients.Users[0]))
-	ctx.Notice("Sent %d bytes", sentBytes)
+	if item, code = findBookContact(ctx); item == nil {
+		WriteStatus(w, code)
+		return
+	}
+
+	uid = item.Id
+
+	if code = checkPreconditions(r, item); code != 0 {
+		ctx.Warn("Precondition failed for contact %d", uid)
+		WriteStatus(w, code)
+		return
+	}
+
+	if res, err = ctx.DeleteClient(ctx.User, ctx.Password, uid); err != nil {
+		ctx.Error(err)
+		WriteStatus(w, NewSbssError(err).Code)
+		return
+	}
+
+	if !res.Success {
+		ctx.Error("Can't delete client %d: %s", uid, res.Error)
+		WriteStatus(w, NewSbssError(&SbssResponseError{res.Challenge, res.Error}).Code)
+		return
+	}
+
+	ctx.Notice("Contact %d deleted", uid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Найди клиента SBSS по идентификатору. Если клиент не найден,
+// то вернется код ответа, который следует передать клиенту
+func findContact(ctx *ContextAdapter, uid int) (item *User, code int) {
+	var (
+		clients *ClientsList
+		err     error
+
+		filter = &ClientsRequest{
+			Contacts: 1,
+			Uid:      uid,
+		}
+	)
+
+	if clients, err = ctx.GetClients(ctx.User, ctx.Password, filter); err != nil {
+		ctx.Error(err)
+		return nil, NewSbssError(err).Code
+	}
+
+	if !clients.Success && clients.Error != "" {
+		ctx.Error(clients.Error)
+		return nil, NewSbssError(&SbssResponseError{clients.Challenge, clients.Error}).Code
+	}
+
+	for _, v := range clients.Users {
+		if v.Id == uid {
+			return v, http.StatusOK
+		}
+	}
+
+	ctx.Warn("Can't get user by id %d", uid)
+
+	return nil, http.StatusNotFound
+}
+
+// Имя ресурса контакта в пути /carddav/:book/:contact, для прежних
+// адресов /carddav/:contact без книги
+func contactName(ctx *ContextAdapter) string {
+	if v := ctx.Params.ByName("contact"); v != "" {
+		return v
+	}
+
+	return ctx.Params.ByName("book")
+}
+
+// Найди контакт или группу по имени ресурса в книге запроса
+func findBookContact(ctx *ContextAdapter) (item *User, code int) {
+	var name = contactName(ctx)
+
+	switch {
+	case groupId(name) > 0:
+		item, code = findGroup(ctx, groupId(name))
+
+	case isContactName(name):
+		item, code = findContact(ctx, contactId(name))
+
+	default:
+		ctx.Warn("Unknown contact resource: %s", name)
+		return nil, http.StatusNotFound
+	}
+
+	if item != nil && !contextBook(ctx).Contains(item) {
+		ctx.Warn("Contact %s is not in %s", name, contextBook(ctx).Name())
+		return nil, http.StatusNotFound
+	}
+
+	return
+}
+
+// Имя ресурса соответствует клиенту SBSS: client-<id>.vcf
+// или прежнее uuid-<id>.vcf
+func isContactName(name string) bool {
+	return contactId(name) > 0
+}
+
+// Проверь заголовки If-Match и If-None-Match по ETag контакта
+// в любом из форматов, item равен nil, если контакта нет. Вернет 0,
+// если условия выполнены, иначе код ответа
+func checkPreconditions(r *http.Request, item *User) int {
+	if v := r.Header.Get("If-Match"); v != "" {
+		if item == nil || (strings.TrimSpace(v) != "*" && !matchContactETag(v, item)) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if v := r.Header.Get("If-None-Match"); v != "" && item != nil {
+		if strings.TrimSpace(v) == "*" || matchContactETag(v, item) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	return 0
+}
+
+// Проверь условия If-None-Match по ETag представления контакта
+// в формате и If-Modified-Since. Дата изменения проверяется, только
+// если клиент не передал ETag
+func notModified(r *http.Request, item *User, format *AddressDataType) bool {
+	var (
+		since time.Time
+		err   error
+	)
+
+	if v := r.Header.Get("If-None-Match"); v != "" {
+		return strings.TrimSpace(v) == "*" || matchETag(v, format.ETag(item))
+	}
+
+	if v := r.Header.Get("If-Modified-Since"); v != "" && !item.Updated.IsZero() {
+		if since, err = http.ParseTime(v); err != nil {
+			return false
+		}
+
+		return !item.Updated.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// Найди ETag в списке значений заголовка
+func matchETag(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(v), "W/") == etag {
+			return true
+		}
+	}
+
+	return false
 }
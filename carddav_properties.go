@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	NamespaceDAV     = "DAV:"
+	NamespaceCardDAV = "urn:ietf:params:xml:ns:carddav"
+	NamespaceCS      = "http://calendarserver.org/ns/"
+
+	// Наибольший размер vCard, который принимает сервер
+	MaxResourceSize = 65536
+)
+
+// Префиксы пространств имен в ответе, объявлены в multistatus
+var Namespace_Prefixes = map[string]string{
+	NamespaceDAV:     "d",
+	NamespaceCardDAV: "card",
+	NamespaceCS:      "cs",
+}
+
+// Описание свойства в реестре Known_Properties
+type Property_Definition struct {
+	Namespace string
+	Name      string
+	// Типы ресурсов, у которых есть свойство
+	Resources []int
+	// Свойство вычисляется дорого или не относится к RFC 4918,
+	// поэтому передается только по явному запросу, не в allprop
+	Explicit bool
+	// Значение - текст, а не XML, оно экранируется при записи
+	// ответа без промежуточной копии
+	Text bool
+	// Значение свойства в контексте запроса. Ошибка DAV_Error
+	// задает статус свойства, остальные ошибки считаются
+	// ошибками обращения к SBSS
+	Value func(*ContextAdapter) ([]byte, error)
+}
+
+// Свойство из реестра в запросе клиента
+type Known_XML_Property struct {
+	XML_Property
+	// Параметры свойства в запросе
+	XmlRequest Property_XML_Request
+	def        *Property_Definition
+}
+
+// Атрибуты и вложенные элементы свойства в запросе. Сейчас
+// их передает только card:address-data, RFC 6352 10.4
+type Property_XML_Request struct {
+	ContentType string                     `xml:"content-type,attr"`
+	Version     string                     `xml:"version,attr"`
+	AllProp     *struct{}                  `xml:"allprop"`
+	Props       []*AddressProp_XML_Request `xml:"prop"`
+}
+
+// Свойство vCard, запрошенное в card:address-data
+type AddressProp_XML_Request struct {
+	Name    string `xml:"name,attr"`
+	NoValue string `xml:"novalue,attr"`
+}
+
+// Реестр известных свойств по имени с пространством имен
+var Known_Properties = make(map[xml.Name]*Property_Definition)
+
+// Все типы ресурсов
+var AllResources = []int{ResourceCollection, ResourceHome, ResourcePrincipal, ResourceContact}
+
+// Зарегистрируй свойство, повторная регистрация заменит
+// описание свойства
+func RegisterProperty(def *Property_Definition) {
+	if _, ok := Namespace_Prefixes[def.Namespace]; !ok {
+		panic("Unknown property namespace: " + def.Namespace)
+	}
+
+	Known_Properties[xml.Name{Space: def.Namespace, Local: def.Name}] = def
+}
+
+// Получи свойство из реестра, вернет nil для неизвестного свойства
+func LookupProperty(name xml.Name) XMLPropertyIface {
+	var def, ok = Known_Properties[name]
+
+	if !ok {
+		return nil
+	}
+
+	return &Known_XML_Property{
+		XML_Property: XML_Property{
+			XmlName:     def.Name,
+			XmlNsPrefix: Namespace_Prefixes[def.Namespace],
+			XmlStatus:   http.StatusOK,
+		},
+		def: def,
+	}
+}
+
+// Список свойств реестра в порядке имен
+func KnownProperties() (props XML_Properties) {
+	var names []xml.Name
+
+	for name := range Known_Properties {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Local == names[j].Local {
+			return names[i].Space < names[j].Space
+		}
+
+		return names[i].Local < names[j].Local
+	})
+
+	for _, name := range names {
+		props = append(props, LookupProperty(name))
+	}
+
+	return
+}
+
+// Проверь, что свойство есть у ресурса
+func (this *Property_Definition) Applies(resource int) bool {
+	for _, item := range this.Resources {
+		if item == resource {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *Known_XML_Property) Applies(resource int) bool {
+	return this.def.Applies(resource)
+}
+
+// Свойство входит в ответ на allprop
+func (this *Known_XML_Property) AllProp() bool {
+	return !this.def.Explicit
+}
+
+// Вычисли значение свойства для ресурса запроса, у других
+// ресурсов свойство не найдено
+func (this *Known_XML_Property) XmlElem(ctx *ContextAdapter) XML_Element {
+	var (
+		err  error
+		data []byte
+		elem = this.XML_Property.XmlElem(ctx)
+	)
+
+	if !this.def.Applies(ctx.Resource) {
+		elem.Status = http.StatusNotFound
+		return elem
+	}
+
+	if data, err = this.def.Value(ctx); err != nil {
+		e := NewSbssError(err)
+
+		if _, ok := err.(*DAV_Error); !ok {
+			ctx.Error(err)
+			elem.Error = "SBSS server request failed"
+		}
+
+		elem.Status = e.Code
+		elem.Condition = e.Condition
+		return elem
+	}
+
+	if this.def.Text {
+		elem.Text = data
+	} else {
+		elem.Data = data
+	}
+
+	return elem
+}
+
+// Значение свойства без обращения к контексту
+func staticValue(data string) func(*ContextAdapter) ([]byte, error) {
+	return func(ctx *ContextAdapter) ([]byte, error) {
+		return []byte(data), nil
+	}
+}
+
+// Адрес ресурса пользователя (principal), RFC 5397
+func principalHref(ctx *ContextAdapter) ([]byte, error) {
+	return []byte("<d:href>" + string(escapeText(ctx.URL.Principal(ctx.User))) + "</d:href>"), nil
+}
+
+// Контакт запроса, без контакта свойство не найдено
+func contextContact(ctx *ContextAdapter) (*User, error) {
+	if ctx.Contact == nil {
+		return nil, NewDAVError(http.StatusNotFound, "")
+	}
+
+	return ctx.Contact, nil
+}
+
+func init() {
+	// RFC 4918
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "displayname",
+		Resources: []int{ResourcePrincipal, ResourceHome, ResourceCollection},
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			switch ctx.Resource {
+			case ResourcePrincipal:
+				return escapeText(ctx.User), nil
+
+			case ResourceHome:
+				return []byte("SBSS"), nil
+			}
+
+			return escapeText(contextBook(ctx).DisplayName(ctx)), nil
+		},
+	})
+
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "resourcetype",
+		Resources: AllResources,
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			switch ctx.Resource {
+			case ResourcePrincipal:
+				return []byte("<d:principal/>"), nil
+
+			case ResourceHome:
+				return []byte("<d:collection/>"), nil
+
+			case ResourceContact:
+				return []byte{}, nil
+			}
+
+			return []byte("<d:collection/><card:addressbook/>"), nil
+		},
+	})
+
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "getcontenttype",
+		Resources: []int{ResourceContact},
+		Value:     staticValue("text/vcard; charset=utf-8"),
+	})
+
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "getetag",
+		Resources: []int{ResourceContact},
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			item, err := contextContact(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			return escapeText(contextAddressData(ctx).ETag(item)), nil
+		},
+	})
+
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "getlastmodified",
+		Resources: []int{ResourceContact},
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			item, err := contextContact(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			if item.Updated.IsZero() {
+				return nil, NewDAVError(http.StatusNotFound, "")
+			}
+
+			return []byte(item.Updated.UTC().Format(http.TimeFormat)), nil
+		},
+	})
+
+	// SBSS не хранит дату создания клиента, поэтому используется
+	// дата последнего изменения
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "creationdate",
+		Resources: []int{ResourceContact},
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			item, err := contextContact(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			if item.Updated.IsZero() {
+				return nil, NewDAVError(http.StatusNotFound, "")
+			}
+
+			return []byte(item.Updated.UTC().Format(time.RFC3339)), nil
+		},
+	})
+
+	// RFC 3744 и RFC 5397
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "owner",
+		Resources: AllResources,
+		Explicit:  true,
+		Value:     principalHref,
+	})
+
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "current-user-principal",
+		Resources: AllResources,
+		Explicit:  true,
+		Value:     principalHref,
+	})
+
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "principal-URL",
+		Resources: []int{ResourcePrincipal},
+		Explicit:  true,
+		Value:     principalHref,
+	})
+
+	// RFC 3253
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "supported-report-set",
+		Resources: []int{ResourceCollection},
+		Explicit:  true,
+		Value: staticValue("<d:supported-report><d:report><d:sync-collection/></d:report></d:supported-report>" +
+			"<d:supported-report><d:report><card:addressbook-query/></d:report></d:supported-report>" +
+			"<d:supported-report><d:report><card:addressbook-multiget/></d:report></d:supported-report>"),
+	})
+
+	// RFC 4331, новые контакты через CardDAV не создаются
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "quota-available-bytes",
+		Resources: []int{ResourceHome, ResourceCollection},
+		Explicit:  true,
+		Value:     staticValue("0"),
+	})
+
+	// RFC 6578
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceDAV,
+		Name:      "sync-token",
+		Resources: []int{ResourceCollection},
+		Explicit:  true,
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			token, err := contextBook(ctx).SyncToken(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			return escapeText(token), nil
+		},
+	})
+
+	// RFC 6352
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceCardDAV,
+		Name:      "addressbook-home-set",
+		Resources: []int{ResourcePrincipal},
+		Explicit:  true,
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			return []byte("<d:href>" + string(escapeText(ctx.URL.Home())) + "</d:href>"), nil
+		},
+	})
+
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceCardDAV,
+		Name:      "addressbook-description",
+		Resources: []int{ResourceCollection},
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			return escapeText(contextBook(ctx).Description(ctx)), nil
+		},
+	})
+
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceCardDAV,
+		Name:      "supported-address-data",
+		Resources: []int{ResourceCollection},
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			var data string
+
+			for _, item := range AddressDataTypes {
+				data += item.XmlElem()
+			}
+
+			return []byte(data), nil
+		},
+	})
+
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceCardDAV,
+		Name:      "max-resource-size",
+		Resources: []int{ResourceCollection},
+		Value:     staticValue(strconv.Itoa(MaxResourceSize)),
+	})
+
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceCardDAV,
+		Name:      "address-data",
+		Resources: []int{ResourceContact},
+		Explicit:  true,
+		Text:      true,
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			item, err := contextContact(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			return contextAddressData(ctx).Encode(item, ctx.AddressProps), nil
+		},
+	})
+
+	// CTag, для книги класса клиентов тэг совпадает с sync-token
+	RegisterProperty(&Property_Definition{
+		Namespace: NamespaceCS,
+		Name:      "getctag",
+		Resources: []int{ResourceCollection},
+		Explicit:  true,
+		Value: func(ctx *ContextAdapter) ([]byte, error) {
+			var (
+				err   error
+				token string
+				etag  *ClientsETag
+				book  = contextBook(ctx)
+			)
+
+			if book.Classid != 0 {
+				if token, err = book.SyncToken(ctx); err != nil {
+					return nil, err
+				}
+
+				return []byte(`"` + token + `"`), nil
+			}
+
+			if etag, err = ctx.GetClientsETag(ctx.User, ctx.Password); err != nil {
+				return nil, err
+			}
+
+			if !etag.Success && etag.Error != "" {
+				return nil, &SbssResponseError{Challenge: etag.Challenge, Message: etag.Error}
+			}
+
+			return []byte(`"` + etag.ETag + `"`), nil
+		},
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_RegisterProperty_Lookup(t *testing.T) {
+	if item := LookupProperty(xml.Name{Space: NamespaceCS, Local: "getctag"}); item == nil || item.Prefix() != "cs:" {
+		t.Errorf("Expected registered cs:getctag, got %+v", item)
+	}
+
+	if item := LookupProperty(xml.Name{Space: NamespaceDAV, Local: "getctag"}); item != nil {
+		t.Errorf("Property from other namespace must be unknown, got %+v", item)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic for unknown namespace")
+		}
+	}()
+
+	RegisterProperty(&Property_Definition{Namespace: "urn:unknown", Name: "foo"})
+}
+
+func Test_KnownProperty_Resources(t *testing.T) {
+	var (
+		tt   = &TestingWrap{t}
+		user = &User{Id: 333, Uid: "uuid-333"}
+	)
+
+	for i, item := range []struct {
+		name     xml.Name
+		resource int
+		contact  *User
+		status   int
+		data     string
+	}{
+		{xml.Name{Space: NamespaceDAV, Local: "getetag"}, ResourceCollection, nil, http.StatusNotFound, ""},
+		{xml.Name{Space: NamespaceDAV, Local: "getetag"}, ResourceContact, user, http.StatusOK, "&#34;" + strings.Trim(user.ETag(), `"`) + "&#34;"},
+		{xml.Name{Space: NamespaceDAV, Local: "getlastmodified"}, ResourceContact, user, http.StatusNotFound, ""},
+		{xml.Name{Space: NamespaceDAV, Local: "owner"}, ResourceContact, user, http.StatusOK, "<d:href>/principals/userfoo/</d:href>"},
+		{xml.Name{Space: NamespaceDAV, Local: "principal-URL"}, ResourceHome, nil, http.StatusNotFound, ""},
+		{xml.Name{Space: NamespaceDAV, Local: "quota-available-bytes"}, ResourceCollection, nil, http.StatusOK, "0"},
+		{xml.Name{Space: NamespaceCardDAV, Local: "max-resource-size"}, ResourceCollection, nil, http.StatusOK, strconv.Itoa(MaxResourceSize)},
+		{xml.Name{Space: NamespaceCardDAV, Local: "addressbook-description"}, ResourceCollection, nil, http.StatusOK, "All SBSS clients"},
+		{xml.Name{Space: NamespaceCardDAV, Local: "supported-address-data"}, ResourcePrincipal, nil, http.StatusNotFound, ""},
+		{xml.Name{Space: NamespaceCardDAV, Local: "address-data"}, ResourceContact, user, http.StatusOK, "BEGIN:VCARD"},
+	} {
+		ctx := &ContextAdapter{
+			LogIface: tt,
+			User:     "userfoo",
+			Resource: item.resource,
+			Contact:  item.contact,
+		}
+
+		el := LookupProperty(item.name).XmlElem(ctx)
+
+		if el.Status != item.status {
+			t.Errorf("Unexpected status of %s at %d: %d", item.name.Local, i, el.Status)
+		}
+
+		// Текстовые значения экранируются только при записи ответа
+		if v := string(el.Data) + string(el.Text); item.status == http.StatusOK && !strings.HasPrefix(v, item.data) {
+			t.Errorf("Unexpected value of %s at %d: %s", item.name.Local, i, v)
+		}
+	}
+}
+
+func Test_XMLRequest_ResolveAllprop(t *testing.T) {
+	var req = XML_Request{}
+
+	if err := xml.Unmarshal([]byte(`<D:propfind xmlns:D="DAV:" xmlns:CS="http://calendarserver.org/ns/">
+	<D:allprop/><D:include><CS:getctag/></D:include>
+</D:propfind>`), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	props := req.Resolve(ResourceCollection)
+
+	for _, name := range []string{"displayname", "resourcetype", "supported-address-data", "getctag"} {
+		if props.Get(name) == nil {
+			t.Errorf("Expected %s in allprop", name)
+		}
+	}
+
+	for _, name := range []string{"getetag", "sync-token", "principal-URL"} {
+		if props.Get(name) != nil {
+			t.Errorf("Unexpected %s in allprop", name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"net/http"
+)
+
+// Размер буфера потоковой записи multistatus
+const MultistatusBufferSize = 32 * 1024
+
+// Потоковая запись ответа multistatus, RFC 4918 13. Ответы на
+// ресурсы кодируются в тело при каждом Flush, поэтому в памяти
+// остаются только еще не записанные ответы и буфер записи
+type multistatusStream struct {
+	w       http.ResponseWriter
+	buff    *bufio.Writer
+	enc     *xml.Encoder
+	bytes   int
+	started bool
+	err     error
+}
+
+// Отправь данные клиенту с подсчетом переданных байт
+func (this *multistatusStream) Write(p []byte) (n int, err error) {
+	n, err = this.w.Write(p)
+	this.bytes += n
+
+	return
+}
+
+// Записывай ответы в w по мере их готовности. Заголовки и код
+// ответа отправляются при первом Flush, поэтому ошибки обработки
+// запроса нужно вернуть клиенту до него
+func (this *Multistatus_XML_Response) Stream(w http.ResponseWriter) {
+	var s = &multistatusStream{w: w}
+
+	s.buff = bufio.NewWriterSize(s, MultistatusBufferSize)
+	s.enc = xml.NewEncoder(s.buff)
+
+	this.stream = s
+}
+
+// Ответ клиенту уже начат, код ответа изменить нельзя
+func (this *Multistatus_XML_Response) Started() bool {
+	return this.stream != nil && this.stream.started
+}
+
+// Закодируй накопленные ответы в поток и освободи их. Без
+// потока ответы остаются в Responses
+func (this *Multistatus_XML_Response) Flush() error {
+	var s = this.stream
+
+	if s == nil || s.err != nil {
+		return this.streamError()
+	}
+
+	if !s.started {
+		s.started = true
+
+		s.w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		s.w.WriteHeader(http.StatusMultiStatus)
+
+		if s.err = s.enc.EncodeToken(this.startElement()); s.err != nil {
+			return s.err
+		}
+	}
+
+	for i, item := range this.Responses {
+		if s.err = s.enc.Encode(item); s.err != nil {
+			return s.err
+		}
+
+		this.Responses[i] = nil
+	}
+
+	this.Responses = this.Responses[:0]
+
+	return nil
+}
+
+// Заверши ответ: запиши оставшиеся ответы, sync-token и конец
+// multistatus. Вернет число отправленных байт
+func (this *Multistatus_XML_Response) Close() (int, error) {
+	var s = this.stream
+
+	if s == nil {
+		return 0, nil
+	}
+
+	if this.Flush() != nil {
+		return s.bytes, s.err
+	}
+
+	if this.Token != "" {
+		if s.err = s.enc.EncodeElement(this.Token, xml.StartElement{Name: xml.Name{Local: "d:sync-token"}}); s.err != nil {
+			return s.bytes, s.err
+		}
+	}
+
+	if s.err = s.enc.EncodeToken(this.startElement().End()); s.err == nil {
+		if s.err = s.enc.Flush(); s.err == nil {
+			s.err = s.buff.Flush()
+		}
+	}
+
+	return s.bytes, s.err
+}
+
+func (this *Multistatus_XML_Response) streamError() error {
+	if this.stream == nil {
+		return nil
+	}
+
+	return this.stream.err
+}
+
+// Открывающий элемент multistatus с объявлением пространств имен
+func (this *Multistatus_XML_Response) startElement() xml.StartElement {
+	return xml.StartElement{
+		Name: xml.Name{Local: "d:multistatus"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "xmlns:d"}, Value: this.XmlnsDAV},
+			{Name: xml.Name{Local: "xmlns:card"}, Value: this.XmlnsCard},
+			{Name: xml.Name{Local: "xmlns:cs"}, Value: this.XmlnsCS},
+		},
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Логгер для бенчмарков, сообщения не выводятся
+type DiscardLogWrap struct{}
+
+func (this *DiscardLogWrap) Critical(v ...interface{}) {}
+func (this *DiscardLogWrap) Error(v ...interface{})    {}
+func (this *DiscardLogWrap) Warn(v ...interface{})     {}
+func (this *DiscardLogWrap) Notice(v ...interface{})   {}
+func (this *DiscardLogWrap) Info(v ...interface{})     {}
+func (this *DiscardLogWrap) Debug(v ...interface{})    {}
+
+// Ответ, тело которого не сохраняется
+type DiscardResponseWriter struct {
+	header http.Header
+}
+
+func (this *DiscardResponseWriter) Header() http.Header {
+	if this.header == nil {
+		this.header = make(http.Header)
+	}
+
+	return this.header
+}
+
+func (this *DiscardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (this *DiscardResponseWriter) WriteHeader(code int) {}
+
+// Запрос свойств контактов, как его передают клиенты при синхронизации
+func multistatusTestRequest() *XML_Request {
+	var req = &XML_Request{}
+
+	xml.Unmarshal([]byte(`<C:addressbook-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+	<D:prop><D:getetag/><C:address-data/></D:prop>
+</C:addressbook-multiget>`), req)
+
+	return req
+}
+
+// Клиенты SBSS для бенчмарков
+func multistatusTestUsers(n int) []*User {
+	var users = make([]*User, n)
+
+	for i := range users {
+		id := 1000 + i
+
+		users[i] = &User{
+			Id:        id,
+			Name:      "Client " + strconv.Itoa(id),
+			FullName:  []string{"Client", strconv.Itoa(id)},
+			Email:     &Email{Type: "internet", Value: "client" + strconv.Itoa(id) + "@example.net"},
+			Uid:       "uuid-" + strconv.Itoa(id),
+			Classid:   1,
+			Classname: "Corporate & Co",
+			Updated:   time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC),
+		}
+	}
+
+	return users
+}
+
+func Test_Multistatus_Stream(t *testing.T) {
+	var (
+		tt    = &TestingWrap{t}
+		req   = multistatusTestRequest()
+		users = multistatusTestUsers(3)
+		ctx   = &ContextAdapter{LogIface: tt, User: "userfoo", Href: "/carddav/contacts/"}
+
+		multi  = NewMultiStatus()
+		stream = NewMultiStatus()
+		rr     = httptest.NewRecorder()
+	)
+
+	stream.Stream(rr)
+
+	for _, item := range users {
+		describeContact(req, &multi, ctx, item, ctx.URL.Contact(contextBook(ctx), item))
+		describeContact(req, &stream, ctx, item, ctx.URL.Contact(contextBook(ctx), item))
+	}
+
+	if !stream.Started() || len(stream.Responses) != 0 {
+		t.Errorf("Expected flushed responses, pending %d", len(stream.Responses))
+	}
+
+	multi.AddStatusResponse("/carddav/uuid-1.vcf", http.StatusNotFound)
+	stream.AddStatusResponse("/carddav/uuid-1.vcf", http.StatusNotFound)
+	multi.Token, stream.Token = "token", "token"
+
+	want, err := xml.Marshal(multi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusMultiStatus || n != rr.Body.Len() {
+		t.Errorf("Unexpected response: %d, %d bytes of %d", rr.Code, n, rr.Body.Len())
+	}
+
+	if v := rr.Body.String(); v != string(want) {
+		t.Errorf("Stream differs from marshaled response:\n%s\n%s", v, want)
+	}
+}
+
+// Ответ на multiget по n контактам: stream - запись ответов по мере
+// готовности, иначе весь ответ собирается и кодируется в памяти
+func benchmarkMultistatus(b *testing.B, n int, stream bool) {
+	var (
+		req   = multistatusTestRequest()
+		users = multistatusTestUsers(n)
+		ctx   = &ContextAdapter{LogIface: &DiscardLogWrap{}, User: "userfoo", Href: "/carddav/contacts/"}
+	)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var (
+			w     = &DiscardResponseWriter{}
+			multi = NewMultiStatus()
+		)
+
+		if stream {
+			multi.Stream(w)
+		}
+
+		for _, item := range users {
+			describeContact(req, &multi, ctx, item, ctx.URL.Contact(contextBook(ctx), item))
+		}
+
+		if stream {
+			if _, err := multi.Close(); err != nil {
+				b.Fatal(err)
+			}
+
+			continue
+		}
+
+		body, err := xml.Marshal(multi)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		w.Write(body)
+	}
+}
+
+func Benchmark_Multistatus_Stream10k(b *testing.B) {
+	benchmarkMultistatus(b, 10000, true)
+}
+
+func Benchmark_Multistatus_Stream100k(b *testing.B) {
+	benchmarkMultistatus(b, 100000, true)
+}
+
+func Benchmark_Multistatus_Marshal10k(b *testing.B) {
+	benchmarkMultistatus(b, 10000, false)
+}
+
+func Benchmark_Multistatus_Marshal100k(b *testing.B) {
+	benchmarkMultistatus(b, 100000, false)
+}
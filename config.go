@@ -21,6 +21,18 @@ var (
 	SBSSAPISERVER string
 
 	PrintVersion bool
+	// Разрешить изменение контактов клиентами адресной книги
+	ALLOWWRITE bool
+	// Разрешить удаление клиентов SBSS из адресной книги
+	ALLOWDELETE bool
+	// Наибольшее число изменений в одном ответе sync-collection
+	SYNCLIMIT int
+	// Базовый путь сервиса, если он опубликован не в корне
+	BASEPATH string
+	// Адреса и сети прокси, которым разрешено передавать X-Forwarded-*
+	TRUSTEDPROXIES string
+	// Завершать строки vCard LF вместо CRLF
+	VCARDLF bool
 )
 
 func init() {
@@ -32,6 +44,12 @@ func init() {
 	flag.BoolVar(&PrintVersion, "V", false, "Print version")
 	flag.StringVar(&SERVERADDRESS, "L", ":8080", "Listen http request at [:8080]")
 	flag.StringVar(&SBSSAPISERVER, "A", "http://localhost", "LANBilling SBSS API server address")
+	flag.BoolVar(&ALLOWWRITE, "W", false, "Save contact changes from the address book to SBSS")
+	flag.BoolVar(&ALLOWDELETE, "D", false, "Delete SBSS clients removed from the address book, requires -W")
+	flag.IntVar(&SYNCLIMIT, "S", 1000, "Max changes in one sync-collection response, 0 - unlimited")
+	flag.StringVar(&BASEPATH, "P", "", "Base path of the service, e.g. /dav/sbss")
+	flag.StringVar(&TRUSTEDPROXIES, "T", "", "Comma separated proxy addresses or networks trusted to send X-Forwarded-* headers")
+	flag.BoolVar(&VCARDLF, "U", false, "End vCard lines with LF instead of CRLF for clients that reject CRLF")
 }
 
 // Покажи версию программы и заверши процесс
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Префикс имени ресурса группы контактов класса
+	ContactGroupPrefix = "group-"
+)
+
+// Представление группы в vCard 3.0 с расширениями Apple,
+// их понимают также SOGo и большинство клиентов
+type userGroup3 struct {
+	Name     string   `vcard:"fn,escape"`
+	FullName []string `vcard:"n,inline,escape"`
+	Kind     string   `vcard:"x-addressbookserver-kind"`
+	Members  []string `vcard:"x-addressbookserver-member,iteminline,omitempty"`
+	Uid      string   `vcard:"uid"`
+}
+
+// Собери группы контактов по классам клиентов. Группа - это
+// контакт без идентификатора SBSS со списком участников
+func ContactGroups(users []*User) (groups []*User) {
+	var (
+		classes = make(map[int]*User)
+	)
+
+	for _, item := range users {
+		if item.Classid <= 0 || item.IsGroup() {
+			continue
+		}
+
+		group, ok := classes[item.Classid]
+
+		if !ok {
+			group = &User{
+				Name:      item.Classname,
+				Uid:       GroupUid(item.Classid),
+				Classid:   item.Classid,
+				Classname: item.Classname,
+				Members:   []*User{},
+			}
+
+			if group.Name == "" {
+				group.Name = AddressBookClassPrefix + strconv.Itoa(item.Classid)
+			}
+
+			classes[item.Classid] = group
+			groups = append(groups, group)
+		}
+
+		group.Members = append(group.Members, item)
+
+		if item.Updated.After(group.Updated) {
+			group.Updated = item.Updated
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Classid < groups[j].Classid
+	})
+
+	return
+}
+
+// Контакты коллекции: клиенты книги и группы их классов
+func bookContacts(users []*User) []*User {
+	return append(users[:len(users):len(users)], ContactGroups(users)...)
+}
+
+// Контакт является группой класса
+func (this *User) IsGroup() bool {
+	return this.Members != nil
+}
+
+// Ссылка на контакт в списке участников группы, RFC 6350 6.6.5
+func (this *User) MemberUri() string {
+	return this.Uid
+}
+
+// Ссылки на участников группы в порядке их UID
+func (this *User) MemberUris() (list []string) {
+	for _, item := range this.Members {
+		list = append(list, item.MemberUri())
+	}
+
+	sort.Strings(list)
+
+	return
+}
+
+// Представление группы в vCard 3.0
+func (this *User) Group3() *userGroup3 {
+	return &userGroup3{
+		Name:     this.Name,
+		FullName: []string{this.Name},
+		Kind:     "group",
+		Members:  this.MemberUris(),
+		Uid:      this.Uid,
+	}
+}
+
+// Получи класс клиентов из href или имени ресурса группы,
+// вернет 0, если ресурс не является группой
+func groupId(href string) (id int) {
+	if idx := strings.LastIndex(href, "/"); idx > -1 {
+		href = href[idx+1:]
+	}
+
+	if !strings.HasPrefix(href, ContactGroupPrefix) {
+		return 0
+	}
+
+	if id, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(href, ContactGroupPrefix), ".vcf")); id < 0 {
+		return 0
+	}
+
+	return
+}
+
+// Найди группу класса клиентов, группы без участников нет
+func findGroup(ctx *ContextAdapter, classid int) (item *User, code int) {
+	var (
+		clients *ClientsList
+		err     error
+	)
+
+	if clients, err = (&AddressBook{Classid: classid}).Clients(ctx, nil); err != nil {
+		ctx.Error(err)
+		return nil, NewSbssError(err).Code
+	}
+
+	if groups := ContactGroups(clients.Users); len(groups) > 0 {
+		return groups[0], http.StatusOK
+	}
+
+	ctx.Warn("Can't get group by class %d", classid)
+
+	return nil, http.StatusNotFound
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Префикс UID контакта, RFC 4122 3
+	UidPrefix = "urn:uuid:"
+	// Префикс имен ресурсов контактов client-<id>.vcf
+	ContactNamePrefix = "client-"
+	// Префикс прежних имен ресурсов контактов uuid-<id>.vcf
+	LegacyUidPrefix = "uuid-"
+)
+
+// Пространство имен URL, RFC 4122 Appendix C
+var uuidNamespaceURL = [16]byte{
+	0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1,
+	0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8,
+}
+
+// UUID версии 5 по имени в пространстве имен, RFC 4122 4.3
+func uuid5(namespace [16]byte, name string) (uuid [16]byte) {
+	var h = sha1.New()
+
+	h.Write(namespace[:])
+	h.Write([]byte(name))
+
+	copy(uuid[:], h.Sum(nil))
+
+	uuid[6] = (uuid[6] & 0x0f) | 0x50
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return
+}
+
+// Запиши UUID в каноническом виде
+func formatUUID(uuid [16]byte) string {
+	var buff = make([]byte, 36)
+
+	hex.Encode(buff[0:8], uuid[0:4])
+	buff[8] = '-'
+	hex.Encode(buff[9:13], uuid[4:6])
+	buff[13] = '-'
+	hex.Encode(buff[14:18], uuid[6:8])
+	buff[18] = '-'
+	hex.Encode(buff[19:23], uuid[8:10])
+	buff[23] = '-'
+	hex.Encode(buff[24:], uuid[10:])
+
+	return string(buff)
+}
+
+// Пространство имен UID сервера SBSS: UID клиентов разных
+// серверов не совпадают, даже если совпадают их идентификаторы
+func serverNamespace() [16]byte {
+	return uuid5(uuidNamespaceURL, strings.ToLower(strings.TrimRight(SBSSAPISERVER, "/")))
+}
+
+// UID клиента SBSS
+func ContactUid(id int) string {
+	return UidPrefix + formatUUID(uuid5(serverNamespace(), "client/"+strconv.Itoa(id)))
+}
+
+// UID группы класса клиентов
+func GroupUid(classid int) string {
+	return UidPrefix + formatUUID(uuid5(serverNamespace(), "class/"+strconv.Itoa(classid)))
+}
@@ -22,15 +22,33 @@ func main() {
 	router = NewRouter(SBSSAPISERVER, log)
 	router.watchGarbage()
 
-	router.Handle("PROPFIND", "/.well-known/carddav", func(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
-		http.Redirect(w, r, "/carddav", 301)
-	})
+	router.URL = NewURLBuilder(BASEPATH)
+
+	// Well-known адрес всегда в корне сервера, RFC 6764 5
+	router.Handle("GET", "/.well-known/carddav", HandleWellKnown)
+	router.Handle("PROPFIND", "/.well-known/carddav", HandleWellKnown)
+	router.Handle("OPTIONS", "/.well-known/carddav", HandleWellKnown)
+
+	router.Handle("PROPFIND", router.URL.Route("/principals/:login/"), HandleAuthorize(HandleResource(ResourcePrincipal, HandlePrincipal)))
 
-	router.Handle("PROPFIND", "/carddav/", HandleAuthorize(HandlePropfind))
-	router.Handle("PROPFIND", "/carddav/contacts", HandleAuthorize(HandlePropfind))
-	router.Handle("REPORT", "/carddav/", HandleAuthorize(HandleReport))
-	router.Handle("REPORT", "/carddav/contacts", HandleAuthorize(HandleReport))
-	router.Handle("GET", "/carddav/:contact", HandleAuthorize(HandleGetContact))
+	router.Handle("PROPFIND", router.URL.Route("/carddav/"), HandleAuthorize(HandleResource(ResourceHome, HandlePropfind)))
+	router.HandleFor(ResourceCollection, "PROPFIND", router.URL.Route("/carddav/:book"), HandleAuthorize(HandleAddressBook(HandlePropfind)))
+	router.Handle("PROPFIND", router.URL.Route("/carddav/:book/"), HandleAuthorize(HandleAddressBook(HandlePropfind)))
+	router.Handle("PROPFIND", router.URL.Route("/carddav/:book/:contact"), HandleAuthorize(HandleAddressBook(HandlePropfindContact)))
+	// Старые клиенты синхронизируют общую книгу по адресу /carddav/
+	router.Handle("REPORT", router.URL.Route("/carddav/"), HandleAuthorize(HandleReport))
+	router.HandleFor(ResourceCollection, "REPORT", router.URL.Route("/carddav/:book"), HandleAuthorize(HandleAddressBook(HandleReport)))
+	router.Handle("REPORT", router.URL.Route("/carddav/:book/"), HandleAuthorize(HandleAddressBook(HandleReport)))
+	// GET по адресу книги выгружает все контакты одним файлом, по
+	// адресу /carddav/<имя> без книги доступны прежние адреса контактов
+	router.Handle("GET", router.URL.Route("/carddav/:book"), HandleAuthorize(HandleGetResource))
+	router.Handle("GET", router.URL.Route("/carddav/:book/"), HandleAuthorize(HandleGetResource))
+	router.Handle("GET", router.URL.Route("/carddav/:book/:contact"), HandleAuthorize(HandleAddressBook(HandleGetContact)))
+	router.HandleFor(ResourceContact, "PUT", router.URL.Route("/carddav/:book"), HandleAuthorize(HandlePutContact))
+	router.Handle("PUT", router.URL.Route("/carddav/:book/:contact"), HandleAuthorize(HandleAddressBook(HandlePutContact)))
+	router.HandleFor(ResourceContact, "DELETE", router.URL.Route("/carddav/:book"), HandleAuthorize(HandleDeleteContact))
+	router.Handle("DELETE", router.URL.Route("/carddav/:book/:contact"), HandleAuthorize(HandleAddressBook(HandleDeleteContact)))
+	router.HandleOptions()
 
 	// Handle NotFound
 	router.HandleMethodNotAllowed = false
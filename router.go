@@ -5,6 +5,8 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 	"net/http/httputil"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,11 +19,25 @@ type ContextAdapter struct {
 	LogIface
 	// Интерфейс для обращения к SBSS серверу
 	SbssIface
+	// Хранилище выданных sync-token
+	Tokens *SyncTokens
+	// Адреса ресурсов для ответов клиенту
+	URL *URLBuilder
 	// Параметры маршрута
 	Params   httprouter.Params
 	Href     string
 	User     string
 	Password string
+	// Тип запрашиваемого ресурса
+	Resource int
+	// Запрашиваемая адресная книга
+	Book *AddressBook
+	// Контакт, свойства которого передаются клиенту
+	Contact *User
+	// Формат card:address-data, запрошенный клиентом
+	AddressData *AddressDataType
+	// Свойства vCard из card:prop, nil - все свойства
+	AddressProps map[string]bool
 }
 
 // Расширение функционала маршрутизатора запросов
@@ -34,8 +50,23 @@ type Router struct {
 	Server string
 	// Cache
 	Cache []*Session
+	// Снимки коллекций для sync-collection
+	Tokens *SyncTokens
+	// Адреса маршрутов и ресурсов
+	URL *URLBuilder
+	// Зарегистрированные методы по маршрутам
+	routes map[string][]routeMethod
 }
 
+// Метод маршрута и тип ресурса, к которому он применим
+type routeMethod struct {
+	method   string
+	resource int
+}
+
+// Метод маршрута доступен для ресурса любого типа
+const resourceAny = -1
+
 type Session struct {
 	sync.Mutex
 	id      string
@@ -53,6 +84,9 @@ func NewRouter(url string, log LogIface) *Router {
 		LogIface: log,
 		Router:   httprouter.New(),
 		Server:   url,
+		Tokens:   NewSyncTokens(),
+		URL:      NewURLBuilder(""),
+		routes:   make(map[string][]routeMethod),
 	}
 }
 
@@ -60,6 +94,15 @@ func NewRouter(url string, log LogIface) *Router {
 // чтобы расширить фукнционал и реализовать контекст для
 // входящих запросов
 func (this *Router) Handle(method, path string, handle ContextHandlerFunc) {
+	this.HandleFor(resourceAny, method, path, handle)
+}
+
+// Зарегистрируй метод, который применим только к ресурсу указанного
+// типа, когда по одному маршруту доступны ресурсы разных типов,
+// например, книга и прежний адрес контакта /carddav/<имя>
+func (this *Router) HandleFor(resource int, method, path string, handle ContextHandlerFunc) {
+	this.routes[path] = append(this.routes[path], routeMethod{method, resource})
+
 	this.Router.Handle(method, path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		var (
 			cookie *http.Cookie
@@ -101,11 +144,85 @@ func (this *Router) Handle(method, path string, handle ContextHandlerFunc) {
 			Id:        id,
 			LogIface:  this.LogIface,
 			SbssIface: ses.client,
+			Tokens:    this.Tokens,
+			URL:       this.URL.Request(r),
 			Params:    p,
 		})
 	})
 }
 
+// Зарегистрируй OPTIONS для всех маршрутов, у которых его нет.
+// Вызывается после регистрации остальных маршрутов
+func (this *Router) HandleOptions() {
+	var paths []string
+
+	for path, methods := range this.routes {
+		if !hasRouteMethod(methods, "OPTIONS") {
+			paths = append(paths, path)
+		}
+	}
+
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		this.Handle("OPTIONS", path, this.handleOptions(path))
+	}
+}
+
+// Ответь на OPTIONS методами, доступными ресурсу по адресу
+// запроса: контакту или коллекции
+func (this *Router) handleOptions(path string) ContextHandlerFunc {
+	var (
+		contact    = HandleOptions(this.Allow(path, ResourceContact))
+		collection = HandleOptions(this.Allow(path, ResourceCollection))
+	)
+
+	return func(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+		if isContactName(r.URL.Path) {
+			contact(w, r, ctx)
+			return
+		}
+
+		collection(w, r, ctx)
+	}
+}
+
+// Верни список методов, доступных по маршруту для ресурса
+// указанного типа
+func (this *Router) Allow(path string, resource int) (methods []string) {
+	for _, item := range this.routes[path] {
+		if item.resource == resourceAny || item.resource == resource {
+			methods = append(methods, item.method)
+		}
+	}
+
+	if !hasMethod(methods, "OPTIONS") {
+		methods = append(methods, "OPTIONS")
+	}
+
+	return
+}
+
+func hasRouteMethod(methods []routeMethod, method string) bool {
+	for _, item := range methods {
+		if item.method == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasMethod(methods []string, method string) bool {
+	for _, item := range methods {
+		if item == method {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (this *Router) getSession(sid string) *Session {
 	for _, item := range this.Cache {
 		if item.id == sid {
@@ -150,6 +267,10 @@ func (this *Router) garbage() {
 			this.deleteCacheItem(idx)
 		}
 	}
+
+	if count := this.Tokens.garbage(); count > 0 {
+		this.Debug("gc: Removed %d expired sync tokens", count)
+	}
 }
 
 func (this *Router) watchGarbage() {
@@ -208,6 +329,28 @@ func (this *ContextAdapter) addId(v *[]interface{}) {
 
 }
 
+// Укажи тип ресурса, к которому относится маршрут
+func HandleResource(resource int, fn ContextHandlerFunc) ContextHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+		ctx.Resource = resource
+
+		fn(w, r, ctx)
+	}
+}
+
+// Запрос Basic авторизации в ответах 401
+const AuthChallenge = "Basic realm=Restricted"
+
+// Отправь код ответа. С 401 передается WWW-Authenticate, чтобы
+// клиент снова запросил пароль, например, после отказа SBSS
+func WriteStatus(w http.ResponseWriter, code int) {
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", AuthChallenge)
+	}
+
+	w.WriteHeader(code)
+}
+
 func HandleAuthorize(fn ContextHandlerFunc) ContextHandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
 		var (
@@ -217,7 +360,7 @@ func HandleAuthorize(fn ContextHandlerFunc) ContextHandlerFunc {
 		if ctx.User, ctx.Password, hasAuth = r.BasicAuth(); !hasAuth {
 			ctx.Warn("Unauthorized request")
 
-			w.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
+			w.Header().Set("WWW-Authenticate", AuthChallenge)
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 
 			return
@@ -228,3 +371,19 @@ func HandleAuthorize(fn ContextHandlerFunc) ContextHandlerFunc {
 		fn(w, r, ctx)
 	}
 }
+
+// Ответь на OPTIONS списком классов DAV и доступных методов
+func HandleOptions(methods []string) ContextHandlerFunc {
+	var dav = "1, 3, addressbook"
+
+	if hasMethod(methods, "REPORT") {
+		dav += ", sync-collection"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {
+		w.Header().Set("DAV", dav)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_RouterOptions_AllowHeader(t *testing.T) {
+	var (
+		tt     = &TestingWrap{t}
+		router = NewRouter("", tt)
+		none   = func(w http.ResponseWriter, r *http.Request, ctx *ContextAdapter) {}
+	)
+
+	router.Handle("PROPFIND", "/carddav/", none)
+	router.Handle("REPORT", "/carddav/", none)
+	router.HandleFor(ResourceCollection, "PROPFIND", "/carddav/:book", none)
+	router.Handle("GET", "/carddav/:book", none)
+	router.HandleFor(ResourceContact, "PUT", "/carddav/:book", none)
+	router.HandleFor(ResourceContact, "DELETE", "/carddav/:book", none)
+	router.HandleOptions()
+
+	for path, want := range map[string][2]string{
+		"/carddav/":             {"PROPFIND, REPORT, OPTIONS", "1, 3, addressbook, sync-collection"},
+		"/carddav/contacts":     {"PROPFIND, GET, OPTIONS", "1, 3, addressbook"},
+		"/carddav/uuid-333.vcf": {"GET, PUT, DELETE, OPTIONS", "1, 3, addressbook"},
+	} {
+		req, err := http.NewRequest("OPTIONS", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("Unexpected status for %s: %d", path, rr.Code)
+		}
+
+		if v := rr.Header().Get("Allow"); v != want[0] {
+			t.Errorf("Unexpected Allow for %s: %s", path, v)
+		}
+
+		if v := rr.Header().Get("DAV"); v != want[1] {
+			t.Errorf("Unexpected DAV for %s: %s", path, v)
+		}
+	}
+}
@@ -34,21 +34,40 @@ type ClientsETag struct {
 	Success bool `json:"success"`
 }
 
+type ClientsResponse struct {
+	// В случае, если запрос будет отклонен по причине
+	// авторизации, то вернется заполненный challenge
+	Challenge int `json:"challenge"`
+	// Текст ошибки
+	Error string `json:"error"`
+	// Статус ответа: успех/ошибка
+	Success bool `json:"success"`
+}
+
+// Отказ SBSS сервера выполнить запрос
+type SbssResponseError struct {
+	Challenge int
+	Message   string
+}
+
 type User struct {
 	Id           int       `json:"id" vcard:"-"`
-	Name         string    `json:"name" vcard:"fn"`
+	Name         string    `json:"name" vcard:"fn,escape"`
 	Type         int       `json:"type" vcard:"-"`
-	Organization string    `json:"-" vcard:"org"`
-	FullName     []string  `json:"-" vcard:"n,inline"`
+	Organization string    `json:"-" vcard:"org,escape"`
+	FullName     []string  `json:"-" vcard:"n,inline,escape"`
 	Email        *Email    `json:"email" vcard:"email,separator(;),inline,iteminline(:)"`
 	Uid          string    `json:"-" vcard:"uid"`
-	Classname    string    `json:"classname" vcard:"categories"`
+	Classid      int       `json:"classid" vcard:"-"`
+	Classname    string    `json:"classname" vcard:"categories,escape"`
 	Updated      time.Time `json:"update" vcard:"-"`
+	// Участники группы класса, nil у клиентов SBSS
+	Members []*User `json:"-" vcard:"-"`
 }
 
 type Email struct {
 	Type  string `vcard:",separator(=)"`
-	Value string `vcard:",omitname"`
+	Value string `vcard:",omitname,escape"`
 }
 
 type ClientsRequest struct {
@@ -58,11 +77,30 @@ type ClientsRequest struct {
 	Contacts int    `url:"contacts"`
 	Classid  int    `url:"classid"`
 	Uid      int    `url:"uid"`
+	// Строка поиска по имени и email клиента
+	Search string `url:"search,omitempty"`
+	// Ограничение количества клиентов в ответе
+	Limit int `url:"limit,omitempty"`
+	// Список идентификаторов клиентов через запятую
+	Ids string `url:"ids,omitempty"`
+}
+
+// Запрос на изменение или удаление клиента
+type ClientsSetRequest struct {
+	Async int    `url:"async"`
+	Inc   string `url:"inc"`
+	Cmd   string `url:"cmd"`
+	Uid   int    `url:"uid"`
+	Name  string `url:"name,omitempty"`
+	// Передается всегда: пустое значение удаляет адрес клиента
+	Email string `url:"email"`
 }
 
 type SbssIface interface {
 	GetClients(string, string, *ClientsRequest) (*ClientsList, error)
 	GetClientsETag(string, string) (*ClientsETag, error)
+	SetClient(string, string, *User) (*ClientsResponse, error)
+	DeleteClient(string, string, int) (*ClientsResponse, error)
 }
 
 // Расширение http клиента из пакета gosbss
@@ -154,6 +192,65 @@ func (this *SbssClient) GetClientsETag(user, pass string) (etag *ClientsETag, er
 	return
 }
 
+// Сохрани имя и email клиента в SBSS, без email адрес клиента удаляется
+func (this *SbssClient) SetClient(user, pass string, client *User) (result *ClientsResponse, err error) {
+	var (
+		email string
+	)
+
+	if client.Email != nil {
+		email = client.Email.Value
+	}
+
+	return this.modify(user, pass, &ClientsSetRequest{
+		Cmd:   "set",
+		Uid:   client.Id,
+		Name:  client.Name,
+		Email: email,
+	})
+}
+
+// Удали клиента в SBSS
+func (this *SbssClient) DeleteClient(user, pass string, uid int) (result *ClientsResponse, err error) {
+	return this.modify(user, pass, &ClientsSetRequest{
+		Cmd: "delete",
+		Uid: uid,
+	})
+}
+
+func (this *SbssClient) modify(user, pass string, data *ClientsSetRequest) (result *ClientsResponse, err error) {
+	var (
+		auth *gosbss.AuthRequest
+		form *bytes.Buffer
+		res  *http.Response
+	)
+
+	// Аутентифицируй
+	auth = gosbss.NewAuthRequest(user, pass)
+	if err = this.Client.Login(this.server, auth); err != nil {
+		return
+	}
+
+	data.Async = 1
+	data.Inc = "clients"
+
+	if form, err = gosbss.EncodeForm(data); err != nil {
+		return
+	}
+
+	if res, err = this.post(form); err != nil {
+		return
+	}
+
+	// Read response
+	result = &ClientsResponse{}
+	if err = gosbss.ReadResponse(res, &result); err != nil {
+		return
+	}
+
+	return
+}
+
 // Посылай POST запрос к SBSS серверу
 // Подразумевается, что ApiKey объект определен
 func (this *SbssClient) post(data *bytes.Buffer) (res *http.Response, err error) {
@@ -168,6 +265,15 @@ func (this *SbssClient) post(data *bytes.Buffer) (res *http.Response, err error)
 	return this.Do(req)
 }
 
+func (this *SbssResponseError) Error() string {
+	return "SBSS: " + this.Message
+}
+
+// Верни ETag контакта в формате по умолчанию
+func (this *User) ETag() string {
+	return AddressDataTypes[0].ETag(this)
+}
+
 func (this *User) UnmarshalJSON(b []byte) (err error) {
 	var t = make(map[string]interface{})
 
@@ -178,9 +284,13 @@ func (this *User) UnmarshalJSON(b []byte) (err error) {
 	this.Id, _ = strconv.Atoi(t["id"].(string))
 	this.Name, _ = t["name"].(string)
 	this.Type, _ = strconv.Atoi(t["type"].(string))
-	this.Uid = "uuid-" + strconv.Itoa(this.Id)
+	this.Uid = ContactUid(this.Id)
 	this.Classname, _ = t["classname"].(string)
 
+	if v, ok := t["classid"].(string); ok {
+		this.Classid, _ = strconv.Atoi(v)
+	}
+
 	if tt, ok := t["updated"].(string); ok && tt != "" {
 		this.Updated, _ = time.Parse("2006-01-02 15:04:05", tt)
 	}
@@ -200,3 +310,41 @@ func (this *User) UnmarshalJSON(b []byte) (err error) {
 
 	return
 }
+
+// Свойства vCard, полученной от адресной книги, которые
+// переносятся в клиента SBSS
+type userCardUpload struct {
+	Name         string   `vcard:"fn,escape"`
+	Organization []string `vcard:"org,inline,escape"`
+	Email        []Email  `vcard:"email,separator(;),inline,iteminline(:)"`
+}
+
+// Перенеси в клиента свойства vCard, полученной от адресной книги.
+// Для организаций имя берется из ORG, для остальных из FN
+func (this *User) Apply(card *userCardUpload) {
+	if card.Name != "" {
+		this.Name = card.Name
+	}
+
+	if this.Type == 1 && len(card.Organization) > 0 && card.Organization[0] != "" {
+		this.Name = card.Organization[0]
+	}
+
+	if this.Type == 1 {
+		this.Organization = this.Name
+	} else {
+		this.FullName = strings.Split(this.Name, " ")
+	}
+
+	if len(card.Email) > 0 && card.Email[0].Value != "" {
+		if this.Email == nil {
+			this.Email = &Email{
+				Type: "internet,pref",
+			}
+		}
+
+		this.Email.Value = card.Email[0].Value
+	} else {
+		this.Email = nil
+	}
+}
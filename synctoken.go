@@ -0,0 +1,178 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Префикс sync-token, RFC 6578 требует, чтобы токен был URI
+	SyncTokenPrefix = "urn:x-sbss-vbook:sync:"
+	// Сколько последних снимков хранить для одной коллекции пользователя
+	SyncTokensPerCollection = 4
+	// Время жизни снимка в секундах с последнего использования
+	SyncTokenLifetime = 86400
+)
+
+// Снимок состояния коллекции, выданный клиенту в виде sync-token
+type SyncSnapshot struct {
+	// Токен снимка
+	token string
+	// Владелец снимка
+	user string
+	// Коллекция, для которой выдан токен
+	href string
+	// Когда токен последний раз выдан или предъявлен клиентом,
+	// снимок устаревает по этому времени
+	used time.Time
+	// ETag контактов по их href
+	items map[string]string
+}
+
+// Хранилище выданных sync-token
+type SyncTokens struct {
+	sync.Mutex
+	items []*SyncSnapshot
+}
+
+// Создай хранилище sync-token
+func NewSyncTokens() *SyncTokens {
+	return &SyncTokens{}
+}
+
+// Сохрани снимок коллекции и верни его токен. Если состояние
+// коллекции не изменилось с последнего снимка, то вернется
+// ранее выданный токен, а его срок жизни продлится
+func (this *SyncTokens) Put(user, href string, items map[string]string) string {
+	var (
+		count int
+		last  *SyncSnapshot
+	)
+
+	this.Lock()
+	defer this.Unlock()
+
+	for _, item := range this.items {
+		if item.user == user && item.href == href {
+			last = item
+		}
+	}
+
+	if last != nil && last.equal(items) {
+		last.used = time.Now()
+		return last.token
+	}
+
+	last = &SyncSnapshot{
+		token: SyncTokenPrefix + RandStringId(16),
+		user:  user,
+		href:  href,
+		used:  time.Now(),
+		items: items,
+	}
+
+	this.items = append(this.items, last)
+
+	// Удали самые старые снимки коллекции
+	for i := len(this.items) - 1; i >= 0; i-- {
+		if item := this.items[i]; item.user == user && item.href == href {
+			if count++; count > SyncTokensPerCollection {
+				this.delete(i)
+			}
+		}
+	}
+
+	return last.token
+}
+
+// Найди снимок по токену. Вернется nil, если токен неизвестен,
+// устарел или выдан другому пользователю или коллекции.
+// Найденный снимок считается использованным
+func (this *SyncTokens) Get(user, href, token string) *SyncSnapshot {
+	if !strings.HasPrefix(token, SyncTokenPrefix) {
+		return nil
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	for _, item := range this.items {
+		if item.token == token {
+			if item.user != user || item.href != href {
+				return nil
+			}
+
+			item.used = time.Now()
+
+			return item
+		}
+	}
+
+	return nil
+}
+
+// Remove from the snapshots slice item by index
+func (this *SyncTokens) delete(i int) {
+	var l = len(this.items)
+
+	if i > -1 && i < l {
+		copy(this.items[i:], this.items[i+1:])
+		this.items[l-1] = nil
+		this.items = this.items[:l-1]
+	}
+}
+
+// Удали снимки, которые не использовались дольше SyncTokenLifetime,
+// вернет количество удаленных
+func (this *SyncTokens) garbage() (count int) {
+	var now = time.Now().Unix()
+
+	this.Lock()
+	defer this.Unlock()
+
+	for i := len(this.items) - 1; i >= 0; i-- {
+		if (now - this.items[i].used.Unix()) > SyncTokenLifetime {
+			this.delete(i)
+			count++
+		}
+	}
+
+	return
+}
+
+// Сравни снимок с текущим состоянием коллекции
+func (this *SyncSnapshot) equal(items map[string]string) bool {
+	if len(this.items) != len(items) {
+		return false
+	}
+
+	for href, etag := range items {
+		if v, ok := this.items[href]; !ok || v != etag {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Проверь, появился или изменился контакт с момента снимка
+func (this *SyncSnapshot) Modified(href, etag string) bool {
+	v, ok := this.items[href]
+
+	return !ok || v != etag
+}
+
+// Верни список href, которых больше нет в items
+func (this *SyncSnapshot) Removed(items map[string]string) (list []string) {
+	for href := range this.items {
+		if _, ok := items[href]; !ok {
+			list = append(list, href)
+		}
+	}
+
+	sort.Strings(list)
+
+	return
+}
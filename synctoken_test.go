@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_SyncTokens_Snapshot(t *testing.T) {
+	var (
+		store = NewSyncTokens()
+
+		first = map[string]string{
+			"/carddav/uuid-1.vcf": `"1"`,
+			"/carddav/uuid-2.vcf": `"2"`,
+			"/carddav/uuid-3.vcf": `"3"`,
+		}
+
+		second = map[string]string{
+			"/carddav/uuid-1.vcf": `"1"`,
+			"/carddav/uuid-2.vcf": `"22"`,
+			"/carddav/uuid-4.vcf": `"4"`,
+		}
+	)
+
+	token := store.Put("user", "/carddav/", first)
+
+	if s := store.Put("user", "/carddav/", first); s != token {
+		t.Errorf("Expected the same token for unchanged items, got %s (%s)", s, token)
+	}
+
+	if s := store.Get("other", "/carddav/", token); s != nil {
+		t.Error("Token must not be shared between users")
+	}
+
+	if s := store.Get("user", "/carddav/contacts", token); s != nil {
+		t.Error("Token must not be shared between collections")
+	}
+
+	snap := store.Get("user", "/carddav/", token)
+	if snap == nil {
+		t.Fatal("Expected snapshot")
+	}
+
+	for href, want := range map[string]bool{
+		"/carddav/uuid-1.vcf": false,
+		"/carddav/uuid-2.vcf": true,
+		"/carddav/uuid-4.vcf": true,
+	} {
+		if v := snap.Modified(href, second[href]); v != want {
+			t.Errorf("Unexpected modified state for %s: %v", href, v)
+		}
+	}
+
+	if v := snap.Removed(second); !reflect.DeepEqual(v, []string{"/carddav/uuid-3.vcf"}) {
+		t.Errorf("Unexpected removed list: %v", v)
+	}
+
+	for i := 0; i < SyncTokensPerCollection; i++ {
+		store.Put("user", "/carddav/", map[string]string{"/carddav/uuid-1.vcf": RandStringId(4)})
+	}
+
+	if s := store.Get("user", "/carddav/", token); s != nil {
+		t.Error("Expected the oldest snapshot to be dropped")
+	}
+}
+
+func Test_SyncTokens_Lifetime(t *testing.T) {
+	var (
+		store = NewSyncTokens()
+		items = map[string]string{"/carddav/uuid-1.vcf": `"1"`}
+		old   = time.Now().Add(-2 * SyncTokenLifetime * time.Second)
+	)
+
+	token := store.Put("user", "/carddav/", items)
+	store.items[0].used = old
+
+	if s := store.Put("user", "/carddav/", items); s != token {
+		t.Fatalf("Expected the same token for unchanged items, got %s (%s)", s, token)
+	}
+
+	if n := store.garbage(); n != 0 || store.Get("user", "/carddav/", token) == nil {
+		t.Errorf("Expected reissued token to be kept, removed %d", n)
+	}
+
+	store.items[0].used = old
+
+	if store.Get("user", "/carddav/", token) == nil || store.garbage() != 0 {
+		t.Error("Expected token presented by client to be kept")
+	}
+
+	store.items[0].used = old
+
+	if n := store.garbage(); n != 1 || store.Get("user", "/carddav/", token) != nil {
+		t.Errorf("Expected unused token to expire, removed %d", n)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Адреса ресурсов сервиса. Маршруты регистрируются относительно
+// базового пути, а адреса в ответах клиенту дополнительно учитывают
+// заголовки X-Forwarded-* доверенных прокси. Методы можно вызывать
+// у nil, тогда адреса строятся от корня
+type URLBuilder struct {
+	// Базовый путь сервиса без завершающего /, например, /dav/sbss
+	Base string
+	// Путь, который прокси отрезал перед передачей запроса
+	Prefix string
+	// Схема и хост запроса клиента к прокси
+	Scheme string
+	Host   string
+}
+
+// Создай построитель адресов с базовым путем сервиса
+func NewURLBuilder(base string) *URLBuilder {
+	return &URLBuilder{
+		Base: cleanBasePath(base),
+	}
+}
+
+// Построитель адресов для запроса: заголовки X-Forwarded-Prefix,
+// X-Forwarded-Host и X-Forwarded-Proto учитываются только от
+// доверенных прокси (-T)
+func (this *URLBuilder) Request(r *http.Request) *URLBuilder {
+	var item = &URLBuilder{}
+
+	if this != nil {
+		item.Base = this.Base
+	}
+
+	if !trustedProxy(r.RemoteAddr) {
+		return item
+	}
+
+	item.Prefix = cleanBasePath(forwardedValue(r.Header.Get("X-Forwarded-Prefix")))
+	item.Host = forwardedValue(r.Header.Get("X-Forwarded-Host"))
+	item.Scheme = strings.ToLower(forwardedValue(r.Header.Get("X-Forwarded-Proto")))
+
+	return item
+}
+
+// Путь маршрута с учетом базового пути
+func (this *URLBuilder) Route(path string) string {
+	if this == nil {
+		return path
+	}
+
+	return this.Base + path
+}
+
+// Адрес ресурса сервиса для клиента, path указывается от базового пути
+func (this *URLBuilder) Href(path string) string {
+	return this.External(this.Route(path))
+}
+
+// Адрес для клиента по пути запроса, который уже содержит
+// базовый путь
+func (this *URLBuilder) External(path string) string {
+	if this == nil {
+		return path
+	}
+
+	return this.Prefix + path
+}
+
+// Абсолютный адрес для перенаправления, если прокси передал хост
+func (this *URLBuilder) Absolute(href string) string {
+	var scheme = "http"
+
+	if this == nil || this.Host == "" {
+		return href
+	}
+
+	if this.Scheme == "https" {
+		scheme = this.Scheme
+	}
+
+	return scheme + "://" + this.Host + href
+}
+
+// Домашняя коллекция адресных книг, RFC 6352 7.1.1
+func (this *URLBuilder) Home() string {
+	return this.Href("/carddav/")
+}
+
+// Ресурс пользователя, RFC 5397
+func (this *URLBuilder) Principal(user string) string {
+	return this.Href("/principals/" + url.PathEscape(user) + "/")
+}
+
+// Коллекция адресной книги
+func (this *URLBuilder) Book(book *AddressBook) string {
+	return this.Href("/carddav/" + book.Name() + "/")
+}
+
+// Ресурс контакта в адресной книге: идентификатор клиента SBSS,
+// для группы идентификатор класса. По имени ресурса клиент
+// запрашивается у SBSS без выборки всех клиентов, UUID передается
+// только в свойстве UID
+func (this *URLBuilder) Contact(book *AddressBook, item *User) string {
+	if item.IsGroup() {
+		return this.Book(book) + ContactGroupPrefix + strconv.Itoa(item.Classid) + ".vcf"
+	}
+
+	return this.Book(book) + ContactNamePrefix + strconv.Itoa(item.Id) + ".vcf"
+}
+
+// Приведи базовый путь к виду /path без завершающего /,
+// корень задается пустой строкой
+func cleanBasePath(base string) string {
+	if base = strings.TrimSpace(base); base == "" {
+		return ""
+	}
+
+	if base = path.Clean("/" + base); base == "/" {
+		return ""
+	}
+
+	return base
+}
+
+// Первое значение заголовка X-Forwarded-*, в цепочке прокси
+// оно соответствует запросу клиента
+func forwardedValue(value string) string {
+	return strings.TrimSpace(strings.SplitN(value, ",", 2)[0])
+}
+
+// Проверь, что запрос пришел от доверенного прокси: адрес или
+// сеть из списка -T
+func trustedProxy(remoteAddr string) bool {
+	var (
+		ip   net.IP
+		host = remoteAddr
+	)
+
+	if v, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = v
+	}
+
+	if ip = net.ParseIP(host); ip == nil {
+		return false
+	}
+
+	for _, item := range strings.Split(TRUSTEDPROXIES, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(item); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		if v := net.ParseIP(item); v != nil && v.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"reflect"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
 	VCardTagName = "vcard"
+	// Наибольшая длина строки vCard в октетах без CRLF, RFC 6350 3.2
+	VCardLineLength = 75
 )
 
 // Stuct tags
@@ -18,6 +22,8 @@ const (
 // inline - join all field data inline string
 // omitaname - do not append field name and write value only
 // separator - change default label separator
+// escape - escape backslashes, commas, semicolons and newlines in text value,
+// components of structured and items of list values are escaped separately
 //
 //     struct{
 //         Tel struct {
@@ -41,6 +47,8 @@ type fieldStruct struct {
 	omitempty bool
 	// Skip field label, just write value
 	omitname bool
+	// Экранировать значение типа TEXT, RFC 6350 3.4
+	escape bool
 	// Skip field
 	skip bool
 	// Write vcard virsion if wrap option is on
@@ -48,6 +56,9 @@ type fieldStruct struct {
 	versionnum string
 	// Wrap data with VCARD tokens
 	wrapvcard bool
+	// Свойства, которые нужно передать: имя и признак передачи
+	// значения, nil - все свойства
+	props map[string]bool
 }
 
 type vcardWrap struct {
@@ -55,7 +66,7 @@ type vcardWrap struct {
 }
 
 func Encode(v interface{}) []byte {
-	return element(reflect.ValueOf(v), nil)
+	return foldLines(element(reflect.ValueOf(v), nil))
 }
 
 func EncodeWrap(v interface{}) []byte {
@@ -63,6 +74,58 @@ func EncodeWrap(v interface{}) []byte {
 	return Encode(w)
 }
 
+// Закодируй vCard только со свойствами из props, для свойств
+// со значением false передается только имя, RFC 6352 10.4.2
+func EncodeWrapProps(v interface{}, props map[string]bool) []byte {
+	return encodeProps(vcardWrap{}, v, props)
+}
+
+// Закодируй v с параметрами поля Item структуры wrap
+func encodeProps(wrap interface{}, v interface{}, props map[string]bool) []byte {
+	var opts = fieldOptions(reflect.TypeOf(wrap).Field(0))
+
+	opts.props = props
+
+	return foldLines(element(reflect.ValueOf(v), &opts))
+}
+
+// Перенеси строки длиннее VCardLineLength октетов, не разрывая
+// символы UTF-8, и заверши строки CRLF, RFC 6350 3.2. С ключом -U
+// строки завершаются LF для клиентов, которые не принимают CRLF
+func foldLines(data []byte) []byte {
+	var (
+		buff bytes.Buffer
+		eol  = "\r\n"
+	)
+
+	if VCARDLF {
+		eol = "\n"
+	}
+
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		var n int
+
+		if i > 0 {
+			buff.WriteString(eol)
+		}
+
+		for line = bytes.TrimSuffix(line, []byte("\r")); len(line) > 0; {
+			_, size := utf8.DecodeRune(line)
+
+			if n+size > VCardLineLength {
+				buff.WriteString(eol + " ")
+				n = 1
+			}
+
+			buff.Write(line[:size])
+			n += size
+			line = line[size:]
+		}
+	}
+
+	return buff.Bytes()
+}
+
 func element(v reflect.Value, opts *fieldStruct) (data []byte) {
 	if opts != nil {
 		if opts.skip {
@@ -137,9 +200,17 @@ func walkStruct(v reflect.Value, opts *fieldStruct) (data []byte) {
 
 		fieldOpts = fieldOptions(itemType.Field(i))
 
+		value, ok := true, true
+		if opts != nil && opts.props != nil {
+			if value, ok = opts.props[propertyName(fieldOpts.name)]; !ok {
+				continue
+			}
+		}
+
 		item := element(field, &fieldOpts)
 
-		if !fieldOpts.omitname {
+		// Пустое поле с omitempty пропускается вместе с именем
+		if !fieldOpts.omitname && (len(item) > 0 || !fieldOpts.omitempty) {
 			switch field.Kind() {
 			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
 				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
@@ -155,16 +226,22 @@ func walkStruct(v reflect.Value, opts *fieldStruct) (data []byte) {
 			}
 		}
 
-		if len(item) > 0 {
-			data = append(data, item...)
+		if len(item) > 0 && !value {
+			item = []byte(propertyName(fieldOpts.name) + ":")
+		}
 
-			if i < (length - 1) {
+		// Разделитель ставится только между непустыми полями,
+		// чтобы пропущенные поля не оставляли пустых строк
+		if len(item) > 0 {
+			if len(data) > 0 {
 				if opts != nil && opts.iteminline {
 					data = append(data, []byte(opts.itemglue)...)
 				} else {
 					data = append(data, []byte("\n")...)
 				}
 			}
+
+			data = append(data, item...)
 		}
 	}
 
@@ -216,6 +293,10 @@ func primitive(v reflect.Value, opts *fieldStruct) (data []byte) {
 			return
 		}
 
+		if opts.escape {
+			return []byte(vcardEscaper.Replace(v.String()))
+		}
+
 		return []byte(v.String())
 
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
@@ -234,6 +315,11 @@ func primitive(v reflect.Value, opts *fieldStruct) (data []byte) {
 	return
 }
 
+// Имя свойства без параметров
+func propertyName(name string) string {
+	return strings.SplitN(name, ";", 2)[0]
+}
+
 // Get field properties
 func fieldOptions(f reflect.StructField) (fs fieldStruct) {
 	var (
@@ -279,6 +365,12 @@ func fieldOptions(f reflect.StructField) (fs fieldStruct) {
 			continue
 		}
 
+		if s == "escape" {
+			fs.escape = true
+
+			continue
+		}
+
 		if strings.HasPrefix(s, "inline") {
 			s = strings.Trim(
 				strings.TrimPrefix(s, "inline"),
@@ -344,3 +436,21 @@ func fieldOptions(f reflect.StructField) (fs fieldStruct) {
 
 	return
 }
+
+// Экранирование значений типа TEXT: разделители компонент и
+// элементов списка, обратная косая черта и переводы строк
+var vcardEscaper = strings.NewReplacer(
+	"\\", "\\\\", "\r\n", "\\n", "\n", "\\n", "\r", "\\n", ",", "\\,", ";", "\\;",
+)
+
+// Склей перенесенные строки vCard, RFC 6350 3.2
+func vcardUnfold(text string) string {
+	return strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(text)
+}
+
+// Убери экранирование из значения свойства vCard
+func vcardUnescape(value string) string {
+	return strings.NewReplacer(
+		"\\n", "\n", "\\N", "\n", "\\,", ",", "\\;", ";", "\\\\", "\\",
+	).Replace(value)
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Данные не содержат ни одной vCard
+var ErrNoVCard = errors.New("vcard: BEGIN:VCARD not found")
+
+// Ошибка разбора vCard с номером строки в исходных данных
+type VCardError struct {
+	Line int
+	Msg  string
+}
+
+func (this *VCardError) Error() string {
+	return "vcard: line " + strconv.Itoa(this.Line) + ": " + this.Msg
+}
+
+// Строка содержимого vCard после склейки переносов, RFC 6350 3.3.
+// Имя свойства в верхнем регистре без группы, значение в исходном,
+// экранированном виде
+type vcardLine struct {
+	Num    int
+	Name   string
+	Params map[string][]string
+	Value  string
+}
+
+// Строки одной vCard по именам свойств
+type vcardProps map[string][]*vcardLine
+
+// Чтение vCard из потока, в потоке может быть несколько vCard
+type Decoder struct {
+	r *bufio.Reader
+	// Номер последней прочитанной физической строки
+	num int
+	// Строка, прочитанная при поиске продолжения свойства
+	next    string
+	hasNext bool
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Разбери vCard из data в v. Если v - указатель на срез, то в него
+// записываются все vCard из данных, иначе разбирается первая vCard.
+// Поля заполняются по тем же тегам vcard, что и в Encode
+func Unmarshal(data []byte, v interface{}) (err error) {
+	var (
+		rv = reflect.ValueOf(v)
+		d  = NewDecoder(bytes.NewReader(data))
+	)
+
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("vcard: Unmarshal requires non-nil pointer")
+	}
+
+	if rv.Elem().Kind() != reflect.Slice {
+		if err = d.Decode(v); err == io.EOF {
+			return ErrNoVCard
+		}
+
+		return
+	}
+
+	slice := reflect.MakeSlice(rv.Elem().Type(), 0, 0)
+
+	for {
+		item := reflect.New(slice.Type().Elem())
+
+		if err = d.Decode(item.Interface()); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+
+		slice = reflect.Append(slice, item.Elem())
+	}
+
+	if slice.Len() == 0 {
+		return ErrNoVCard
+	}
+
+	rv.Elem().Set(slice)
+
+	return nil
+}
+
+// Разбери следующую vCard из потока в v, вернет io.EOF, если
+// vCard в потоке больше нет
+func (this *Decoder) Decode(v interface{}) (err error) {
+	var (
+		props vcardProps
+		rv    = reflect.ValueOf(v)
+	)
+
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("vcard: Decode requires non-nil pointer")
+	}
+
+	if props, err = this.readCard(); err != nil {
+		return
+	}
+
+	_, err = decodeNested(rv, props)
+
+	return
+}
+
+// Прочитай строки между BEGIN:VCARD и END:VCARD. Строки вложенных
+// vCard версии 2.1 пропускаются
+func (this *Decoder) readCard() (props vcardProps, err error) {
+	var (
+		line  string
+		num   int
+		item  *vcardLine
+		depth int
+	)
+
+	for {
+		if line, num, err = this.readLine(); err == io.EOF && depth > 0 {
+			return nil, &VCardError{num, "END:VCARD expected"}
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Строки вне vCard не разбираются
+		if item, err = parseVCardLine(line, num); err != nil && depth > 0 {
+			return nil, err
+		} else if err != nil {
+			continue
+		}
+
+		switch {
+		case item.Name == "BEGIN" && strings.EqualFold(item.Value, "VCARD"):
+			if depth++; depth == 1 {
+				props = make(vcardProps)
+			}
+
+		case item.Name == "END" && strings.EqualFold(item.Value, "VCARD"):
+			if depth == 0 {
+				return nil, &VCardError{num, "unexpected END:VCARD"}
+			}
+
+			if depth--; depth == 0 {
+				return props, nil
+			}
+
+		case depth == 1:
+			props[item.Name] = append(props[item.Name], item)
+		}
+	}
+}
+
+// Прочитай строку содержимого, склеив перенесенные строки,
+// RFC 6350 3.2. Пустые строки между vCard пропускаются
+func (this *Decoder) readLine() (line string, num int, err error) {
+	var next string
+
+	// Пробелы в конце строки - часть значения, если строка
+	// перенесена, поэтому обрезанная строка только проверяется
+	for strings.TrimRight(line, " \t") == "" {
+		if line, err = this.readPhysical(); err != nil {
+			return "", this.num, err
+		}
+	}
+
+	num = this.num
+
+	for {
+		if next, err = this.readPhysical(); err == io.EOF {
+			return line, num, nil
+		} else if err != nil {
+			return "", num, err
+		}
+
+		if next == "" || (next[0] != ' ' && next[0] != '\t') {
+			this.next, this.hasNext = next, true
+			return line, num, nil
+		}
+
+		line += next[1:]
+	}
+}
+
+// Прочитай физическую строку без завершающих CRLF или LF
+func (this *Decoder) readPhysical() (line string, err error) {
+	if this.hasNext {
+		this.hasNext = false
+		return this.next, nil
+	}
+
+	if line, err = this.r.ReadString('\n'); err == io.EOF && line != "" {
+		err = nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	this.num++
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// Разбери строку содержимого group.NAME;PARAM=a,"b;c":value.
+// Параметр без имени из vCard 2.1 считается значением TYPE
+func parseVCardLine(line string, num int) (item *vcardLine, err error) {
+	var (
+		parts  []string
+		quoted bool
+		start  int
+		idx    = -1
+	)
+
+	for i := 0; i < len(line) && idx < 0; i++ {
+		switch c := line[i]; {
+		case c == '"':
+			quoted = !quoted
+
+		case quoted:
+
+		case c == ';':
+			parts = append(parts, line[start:i])
+			start = i + 1
+
+		case c == ':':
+			parts = append(parts, line[start:i])
+			idx = i
+		}
+	}
+
+	if idx < 0 {
+		return nil, &VCardError{num, "missing value separator: " + line}
+	}
+
+	item = &vcardLine{
+		Num:    num,
+		Name:   strings.ToUpper(parts[0]),
+		Params: make(map[string][]string),
+		Value:  line[idx+1:],
+	}
+
+	if i := strings.LastIndex(item.Name, "."); i > -1 {
+		item.Name = item.Name[i+1:]
+	}
+
+	if item.Name == "" {
+		return nil, &VCardError{num, "missing property name: " + line}
+	}
+
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+
+		if len(kv) == 1 {
+			kv = []string{"TYPE", kv[0]}
+		}
+
+		name := strings.ToUpper(strings.TrimSpace(kv[0]))
+
+		for _, v := range splitParamValues(kv[1]) {
+			item.Params[name] = append(item.Params[name], v)
+		}
+	}
+
+	return
+}
+
+// Раздели значение параметра по запятым вне кавычек и убери
+// кавычки и кодирование RFC 6868
+func splitParamValues(value string) (list []string) {
+	var (
+		quoted bool
+		start  int
+
+		unescape = strings.NewReplacer("^n", "\n", "^N", "\n", "^'", `"`, "^^", "^")
+	)
+
+	for i := 0; i <= len(value); i++ {
+		if i < len(value) && value[i] == '"' {
+			quoted = !quoted
+			continue
+		}
+
+		if i == len(value) || (value[i] == ',' && !quoted) {
+			list = append(list, unescape.Replace(strings.Trim(value[start:i], `"`)))
+			start = i + 1
+		}
+	}
+
+	return
+}
+
+// Заполни вложенную структуру свойствами той же vCard: так
+// кодируются поля структур без inline, например, Item у vcardWrap.
+// Указатель создается, только если заполнено хотя бы одно поле
+func decodeNested(v reflect.Value, props vcardProps) (set bool, err error) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		item := v
+
+		if v.IsNil() {
+			item = reflect.New(v.Type().Elem())
+		}
+
+		if set, err = decodeNested(item.Elem(), props); set && v.IsNil() {
+			v.Set(item)
+		}
+
+		return
+
+	case reflect.Interface:
+		if !v.IsNil() && v.Elem().Kind() == reflect.Ptr && !v.Elem().IsNil() {
+			return decodeNested(v.Elem(), props)
+		}
+
+		return
+
+	case reflect.Struct:
+		return decodeStruct(v, props)
+	}
+
+	return false, errors.New("vcard: can't decode into " + v.Type().String())
+}
+
+func decodeStruct(v reflect.Value, props vcardProps) (set bool, err error) {
+	var (
+		ok       bool
+		field    reflect.Value
+		opts     fieldStruct
+		itemType = v.Type()
+		length   = itemType.NumField()
+	)
+
+	for i := 0; i < length; i++ {
+		field = v.Field(i)
+		opts = fieldOptions(itemType.Field(i))
+
+		if opts.skip || !field.CanSet() {
+			continue
+		}
+
+		if ok, err = decodeField(field, &opts, props); err != nil {
+			return
+		}
+
+		set = set || ok
+	}
+
+	return
+}
+
+// Заполни поле структуры vCard значениями свойства opts.name
+func decodeField(v reflect.Value, opts *fieldStruct, props vcardProps) (set bool, err error) {
+	var (
+		t     = indirectType(v.Type())
+		lines = props[propertyName(opts.name)]
+	)
+
+	switch {
+	case t.Kind() == reflect.Interface || (t.Kind() == reflect.Struct && !opts.inline):
+		return decodeNested(v, props)
+
+	case len(lines) == 0:
+		return false, nil
+
+	case t.Kind() == reflect.Struct:
+		return true, decodeProperty(v, lines[0])
+
+	case t.Kind() == reflect.Slice:
+		return true, decodeSlice(v, opts, lines)
+	}
+
+	return true, decodeValue(v, vcardUnescape(lines[0].Value), lines[0].Num)
+}
+
+// Заполни срез: для inline компоненты значения первого свойства,
+// иначе по элементу на каждое свойство
+func decodeSlice(v reflect.Value, opts *fieldStruct, lines []*vcardLine) (err error) {
+	var (
+		values []string
+		t      = indirectType(v.Type())
+		elem   = indirectType(t.Elem())
+		slice  = reflect.MakeSlice(t, 0, len(lines))
+	)
+
+	if opts.inline && elem.Kind() != reflect.Struct {
+		values = vcardSplit(lines[0].Value, []rune(opts.glue)[0])
+		lines = lines[:1]
+	}
+
+	for _, line := range lines {
+		item := reflect.New(t.Elem()).Elem()
+
+		if elem.Kind() == reflect.Struct {
+			if err = decodeProperty(item, line); err != nil {
+				return
+			}
+
+			slice = reflect.Append(slice, item)
+			continue
+		}
+
+		if values == nil {
+			values = []string{line.Value}
+		}
+
+		for _, value := range values {
+			item = reflect.New(t.Elem()).Elem()
+
+			if err = decodeValue(item, vcardUnescape(value), line.Num); err != nil {
+				return
+			}
+
+			slice = reflect.Append(slice, item)
+		}
+
+		values = nil
+	}
+
+	indirect(v).Set(slice)
+
+	return
+}
+
+// Заполни структуру свойства: поле omitname получает значение,
+// остальные поля - значения параметров с именем поля
+func decodeProperty(v reflect.Value, line *vcardLine) (err error) {
+	var (
+		field    reflect.Value
+		opts     fieldStruct
+		item     = indirect(v)
+		itemType = item.Type()
+		length   = itemType.NumField()
+	)
+
+	for i := 0; i < length; i++ {
+		field = item.Field(i)
+		opts = fieldOptions(itemType.Field(i))
+
+		if opts.skip || !field.CanSet() {
+			continue
+		}
+
+		if opts.omitname {
+			err = decodeValue(field, vcardUnescape(line.Value), line.Num)
+		} else if values, ok := line.Params[propertyName(opts.name)]; ok {
+			err = decodeValue(field, strings.Join(values, ","), line.Num)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Запиши значение в поле простого типа
+func decodeValue(v reflect.Value, value string, num int) error {
+	v = indirect(v)
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, v.Type().Bits())
+		if err != nil {
+			return &VCardError{num, err.Error()}
+		}
+
+		v.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, v.Type().Bits())
+		if err != nil {
+			return &VCardError{num, err.Error()}
+		}
+
+		v.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), v.Type().Bits())
+		if err != nil {
+			return &VCardError{num, err.Error()}
+		}
+
+		v.SetFloat(n)
+
+	default:
+		return &VCardError{num, "can't decode into " + v.Type().String()}
+	}
+
+	return nil
+}
+
+// Разыменуй указатели, создав их при необходимости
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+
+		v = v.Elem()
+	}
+
+	return v
+}
+
+// Тип значения за указателями
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t
+}
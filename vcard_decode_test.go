@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_Unmarshal_Tags(t *testing.T) {
+	type card struct {
+		Name   string             `vcard:"fn"`
+		Login  string             `vcard:"nickname"`
+		Slice  []string           `vcard:"n,inline"`
+		Phones []vCard_Phone_Test `vcard:"tel,iteminline(:),separator(;)"`
+		Notes  []string           `vcard:"note,iteminline"`
+		Rev    int                `vcard:"x-rev,omitempty"`
+		Skip   string             `vcard:"-"`
+	}
+
+	var (
+		item card
+
+		data = "BEGIN:VCARD\r\n" +
+			"VERSION:3.0\r\n" +
+			"item1.FN:Ivan Ivanovich\r\n" +
+			"  Ivanov\r\n" +
+			"nickname:ivanov\\,login\r\n" +
+			"N:Ivanov;Ivan;Ivanovich\\;Jr;;\r\n" +
+			"TEL;TYPE=cell,voice:+123 00 0000000\r\n" +
+			"TEL;type=\"work\";TYPE=pref:+123 00 1200000\r\n" +
+			"TEL;HOME:+123 00 1230000\r\n" +
+			"NOTE:first\\nline\r\n" +
+			"NOTE:second\r\n" +
+			"X-REV:42\r\n" +
+			"SKIP:value\r\n" +
+			"END:VCARD\r\n"
+
+		mock = card{
+			Name:  "Ivan Ivanovich Ivanov",
+			Login: "ivanov,login",
+			Slice: []string{"Ivanov", "Ivan", "Ivanovich;Jr", "", ""},
+			Phones: []vCard_Phone_Test{
+				{Type: "cell,voice", Value: "+123 00 0000000"},
+				{Type: "work,pref", Value: "+123 00 1200000"},
+				{Type: "HOME", Value: "+123 00 1230000"},
+			},
+			Notes: []string{"first\nline", "second"},
+			Rev:   42,
+		}
+	)
+
+	if err := Unmarshal([]byte(data), &item); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(item, mock) {
+		t.Errorf("Unexpected result:\n%+v\n%+v", item, mock)
+	}
+}
+
+func Test_Unmarshal_Stream(t *testing.T) {
+	var (
+		users []*User
+
+		data = `BEGIN:VCARD
+VERSION:3.0
+FN:Company
+ORG:Company;Sales
+EMAIL;TYPE=internet:sales@example.net
+UID:urn:uuid:1
+END:VCARD
+
+BEGIN:VCARD
+VERSION:2.1
+FN:Agent Smith
+AGENT:
+BEGIN:VCARD
+FN:Nested
+END:VCARD
+END:VCARD
+`
+	)
+
+	if err := Unmarshal([]byte(data), &users); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 cards, but found %d", len(users))
+	}
+
+	if v := users[0]; v.Name != "Company" || v.Organization != "Company;Sales" || v.Email == nil ||
+		*v.Email != (Email{"internet", "sales@example.net"}) || v.Uid != "urn:uuid:1" {
+		t.Errorf("Unexpected first card: %+v", v)
+	}
+
+	if v := users[1]; v.Name != "Agent Smith" || v.Email != nil {
+		t.Errorf("Unexpected second card: %+v", v)
+	}
+
+	d := NewDecoder(bytes.NewReader([]byte(data)))
+
+	for i := 0; i < 2; i++ {
+		if err := d.Decode(&User{}); err != nil {
+			t.Fatalf("Unexpected error at %d: %s", i, err)
+		}
+	}
+
+	if err := d.Decode(&User{}); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+func Test_Unmarshal_RoundTrip(t *testing.T) {
+	var (
+		item User
+
+		mock = &User{
+			Name:      "Ivan Ivanov",
+			FullName:  []string{"Ivan", "Ivanov"},
+			Email:     &Email{Type: "internet,pref", Value: "ivanov@example.net"},
+			Uid:       ContactUid(333),
+			Classname: "Corporate",
+		}
+	)
+
+	if err := Unmarshal(EncodeWrap(mock), &item); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&item, mock) {
+		t.Errorf("Unexpected result:\n%+v\n%+v", item, *mock)
+	}
+
+	wrap := vcardWrap{&User{}}
+
+	if err := Unmarshal(EncodeWrap(mock), &wrap); err != nil || !reflect.DeepEqual(wrap.Item, mock) {
+		t.Errorf("Unexpected wrapped result: %+v, %v", wrap.Item, err)
+	}
+}
+
+func Test_Unmarshal_Errors(t *testing.T) {
+	var item User
+
+	for i, v := range []string{
+		"",
+		"FN:No card",
+		"BEGIN:VCARD\nFN:Unterminated\n",
+		"BEGIN:VCARD\nFN Missing colon\nEND:VCARD\n",
+		"BEGIN:VCARD\n:empty name\nEND:VCARD\n",
+		"END:VCARD\n",
+	} {
+		if err := Unmarshal([]byte(v), &item); err == nil {
+			t.Errorf("Expected error at %d", i)
+		}
+	}
+
+	if err := Unmarshal([]byte("FN:No card"), &item); err != ErrNoVCard {
+		t.Errorf("Expected ErrNoVCard, got %v", err)
+	}
+
+	if err := Unmarshal([]byte("BEGIN:VCARD\nX-REV:abc\nEND:VCARD"), &struct {
+		Rev int `vcard:"x-rev"`
+	}{}); err == nil {
+		t.Error("Expected number parse error")
+	}
+}
+
+func Test_Unmarshal_FoldOnSpace(t *testing.T) {
+	var (
+		item User
+		name = strings.Repeat("a", 71) + " Bcdef"
+		card = EncodeWrap(&User{Name: name, Email: &Email{Type: "internet", Value: "a@example.net"}, Uid: ContactUid(1)})
+	)
+
+	if !strings.Contains(string(card), strings.Repeat("a", 71)+" \r\n Bcdef") {
+		t.Fatalf("Expected fold after space:\n%q", card)
+	}
+
+	if err := Unmarshal(card, &item); err != nil || item.Name != name {
+		t.Errorf("Unexpected name: %q, %v", item.Name, err)
+	}
+
+	if err := Unmarshal([]byte("  \r\n\t\r\nBEGIN:VCARD\r\nFN:a \r\nEND:VCARD\r\n"), &item); err != nil || item.Name != "a " {
+		t.Errorf("Unexpected name after blank lines: %q, %v", item.Name, err)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 type vCard_Contact_Test struct {
@@ -14,6 +16,11 @@ type vCard_Phone_Test struct {
 	Value string `vcard:",omitname"`
 }
 
+// Замени завершения строк на CRLF, как их пишет Encode
+func crlf(s string) string {
+	return strings.Replace(s, "\n", "\r\n", -1)
+}
+
 func Test_EncodeSimpleSingleStruct(t *testing.T) {
 	var (
 		vc = struct {
@@ -49,7 +56,7 @@ TEL;TYPE=work:+123 00 1200000
 TEL;TYPE=home:+123 00 1230000`
 	)
 
-	if d := Encode(vc); string(d) != mock {
+	if d := Encode(vc); string(d) != crlf(mock) {
 		t.Error("Unexpected result")
 		t.Logf("%s", d)
 		t.Log(mock)
@@ -71,7 +78,7 @@ func Test_CardsDataArray_CheckNilOptions(t *testing.T) {
 FN:Noname C`
 	)
 
-	if d := Encode(vc); string(d) != mock {
+	if d := Encode(vc); string(d) != crlf(mock) {
 		t.Error("Unexpected result")
 		t.Logf("%s", d)
 		t.Log(mock)
@@ -110,7 +117,7 @@ END:VCARD
 AGENT:BEGIN:VCARD\nFN:Some coworker C\nEND:VCARD\n`
 	)
 
-	if d := Encode(vc); string(d) != mock {
+	if d := Encode(vc); string(d) != crlf(mock) {
 		t.Error("Unexpected result")
 		t.Logf("%s", d)
 		t.Log(mock)
@@ -252,3 +259,171 @@ func Test_FieldOptionsValid(t *testing.T) {
 		}
 	}
 }
+
+func Test_EncodeWrapProps_Subset(t *testing.T) {
+	var (
+		vc = struct {
+			Name   string             `vcard:"fn"`
+			Login  string             `vcard:"nickname"`
+			Phones []vCard_Phone_Test `vcard:"tel,iteminline(:),separator(;)"`
+		}{
+			Name:  "Ivan Ivanovich Ivanov",
+			Login: "ivanovlogin",
+			Phones: []vCard_Phone_Test{
+				vCard_Phone_Test{
+					Type:  "cell",
+					Value: "+123 00 0000000",
+				},
+			},
+		}
+
+		mock = `BEGIN:VCARD
+VERSION:3.0
+FN:Ivan Ivanovich Ivanov
+NICKNAME:
+END:VCARD
+`
+	)
+
+	if d := EncodeWrapProps(&vc, map[string]bool{"FN": true, "NICKNAME": false}); string(d) != crlf(mock) {
+		t.Error("Unexpected result")
+		t.Logf("%s", d)
+		t.Log(mock)
+	}
+
+	if d, w := EncodeWrapProps(&vc, nil), EncodeWrap(&vc); string(d) != string(w) {
+		t.Error("Expected full vCard without property subset")
+		t.Logf("%s", d)
+	}
+}
+
+func Test_FoldLines(t *testing.T) {
+	var (
+		org  = strings.Repeat("Общество с ограниченной ответственностью ", 4)
+		item = &User{
+			Name:         "Ромашка",
+			Type:         1,
+			Organization: org,
+			Email:        &Email{Type: "internet", Value: "info@example.net"},
+			Uid:          ContactUid(1),
+		}
+		card = EncodeWrap(item)
+	)
+
+	if !strings.HasSuffix(string(card), "END:VCARD\r\n") {
+		t.Errorf("Expected CRLF line endings: %q", card)
+	}
+
+	for i, line := range strings.Split(strings.TrimSuffix(string(card), "\r\n"), "\r\n") {
+		if len(line) > VCardLineLength || !utf8.ValidString(line) || strings.Contains(line, "\n") {
+			t.Errorf("Invalid line %d: %q", i, line)
+		}
+	}
+
+	if !strings.Contains(vcardUnfold(string(card)), "ORG:"+org+"\r\n") {
+		t.Errorf("Unexpected unfolded vCard: %s", vcardUnfold(string(card)))
+	}
+
+	if v := foldLines([]byte("FN:" + strings.Repeat("x", 80))); string(v) != "FN:"+strings.Repeat("x", 72)+"\r\n "+strings.Repeat("x", 8) {
+		t.Errorf("Unexpected folding: %q", v)
+	}
+
+	var decoded User
+
+	if err := Unmarshal(card, &decoded); err != nil || decoded.Organization != org {
+		t.Errorf("Unexpected decoded ORG: %q, %v", decoded.Organization, err)
+	}
+
+	if v := string(vcardToJCard(encodeProps(vcardWrap4{}, item.Card4(), nil))); !strings.Contains(v, `"`+strings.TrimSpace(org)) {
+		t.Errorf("Unexpected jCard ORG: %s", v)
+	}
+
+	defer func(v bool) { VCARDLF = v }(VCARDLF)
+
+	VCARDLF = true
+
+	if v := string(EncodeWrap(item)); strings.Contains(v, "\r") || vcardUnfold(v) != strings.Replace(vcardUnfold(string(card)), "\r\n", "\n", -1) {
+		t.Errorf("Expected LF line endings: %q", v)
+	}
+}
+
+func Test_Encode_Escape(t *testing.T) {
+	var (
+		org = `ООО "Ромашка"; филиал, Москва`
+
+		items = []*User{
+			&User{
+				Name:         org,
+				Type:         1,
+				Organization: org,
+				FullName:     []string{org},
+				Email:        &Email{Type: "internet,pref", Value: "office@romashka.ru"},
+				Uid:          ContactUid(1),
+				Classid:      3,
+				Classname:    "Юр. лица, VIP",
+			},
+			&User{
+				Name:      "Иванов Иван;Иванович\nсклад",
+				FullName:  []string{"Иванов", "Иван;Иванович", `C:\Клиенты`},
+				Email:     &Email{Type: "internet", Value: `a,b\c@example.net`},
+				Uid:       ContactUid(2),
+				Classname: "Физ. лица",
+			},
+		}
+
+		mock = [][]string{
+			{
+				`FN:ООО "Ромашка"\; филиал\, Москва`,
+				`ORG:ООО "Ромашка"\; филиал\, Москва`,
+				`N:ООО "Ромашка"\; филиал\, Москва`,
+				`CATEGORIES:Юр. лица\, VIP`,
+				`EMAIL;TYPE=internet,pref:office@romashka.ru`,
+			},
+			{
+				`FN:Иванов Иван\;Иванович\nсклад`,
+				`N:Иванов;Иван\;Иванович;C:\\Клиенты`,
+				`EMAIL;TYPE=internet:a\,b\\c@example.net`,
+			},
+		}
+	)
+
+	for i, item := range items {
+		card := EncodeWrap(item)
+
+		for _, v := range mock[i] {
+			if !strings.Contains(vcardUnfold(string(card)), v+"\r\n") {
+				t.Errorf("Expected %s at %d:\n%s", v, i, card)
+			}
+		}
+
+		if v := strings.Count(string(card), "\r\n"); v != strings.Count(vcardUnfold(string(card)), "\r\n") || v != 9 {
+			t.Errorf("Unexpected lines at %d:\n%s", i, card)
+		}
+
+		var decoded User
+
+		if err := Unmarshal(card, &decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.Name != item.Name || decoded.Organization != item.Organization || decoded.Classname != item.Classname ||
+			!reflect.DeepEqual(decoded.FullName, item.FullName) || *decoded.Email != *item.Email {
+			t.Errorf("Unexpected decoded card at %d: %+v", i, decoded)
+		}
+	}
+
+	if v := string(AddressDataTypes[1].Encode(items[0], nil)); !strings.Contains(v, mock[0][1]) {
+		t.Errorf("Unexpected vCard 4.0: %s", v)
+	}
+
+	if v := string(AddressDataTypes[2].Encode(items[0], nil)); !strings.Contains(v, `["org",{},"text",["ООО \"Ромашка\"; филиал, Москва"]]`) ||
+		!strings.Contains(v, `["categories",{},"text","Юр. лица, VIP"]`) {
+		t.Errorf("Unexpected jCard: %s", v)
+	}
+
+	group := ContactGroups([]*User{items[0]})[0]
+
+	if v := string(EncodeWrap(group.Group3())); !strings.Contains(v, `FN:Юр. лица\, VIP`) {
+		t.Errorf("Unexpected group vCard: %s", v)
+	}
+}